@@ -0,0 +1,860 @@
+package searchquery
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Program is a query compiled for repeated evaluation. It matches as a
+// Matcher with the same options would, but prepares everything that does
+// not depend on the document once: regexes and wildcards are compiled,
+// values are parsed as numbers, times, bools and IPs, the values of
+// OperatorCSV are split into sets and the clauses of each query are
+// ordered so that cheap ones run first.
+//
+// Match does not allocate for map[string]interface{} documents of strings,
+// numbers, bools, times, []string, []interface{} and nested maps, as long
+// as text is matched against strings. Proximity terms, fuzzy terms of more
+// than 64 runes and text compared to times or IPs still allocate. A Program
+// is safe for concurrent use.
+type Program struct {
+	m      *Matcher
+	root   *group
+	strict bool // fail on a regex that does not compile rather than match nothing
+}
+
+// Compile compiles q into a Program configured by opts. It returns an error
+// if a regex in q does not compile.
+func Compile(q *Query, opts ...MatchOption) (*Program, error) {
+	p := &Program{m: NewMatcher(opts...), strict: true}
+	if q == nil {
+		q = &Query{}
+	}
+	var err error
+	p.root, err = p.group(q)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Match reports whether doc satisfies the query, as Matcher.Match does
+func (p *Program) Match(doc interface{}) bool {
+	if d, ok := doc.(map[string]interface{}); ok {
+		return p.root.match(p, view{m: d})
+	}
+	return p.root.match(p, view{doc: valueDoc{reflect.ValueOf(doc)}})
+}
+
+// view is the document a Program matches, a map read directly where
+// possible
+type view struct {
+	m   map[string]interface{}
+	doc document
+}
+
+// node is a compiled SubQuery
+type node interface {
+	match(p *Program, v view) bool
+	cost() int
+}
+
+// group is a compiled Query
+type group struct {
+	required, optional, excluded []node
+	total                        int
+}
+
+func (p *Program) group(q *Query) (*group, error) {
+	g := &group{}
+	var err error
+	if g.required, err = p.clauses(q.Required); err != nil {
+		return nil, err
+	}
+	if g.optional, err = p.clauses(q.Optional); err != nil {
+		return nil, err
+	}
+	if g.excluded, err = p.clauses(q.Excluded); err != nil {
+		return nil, err
+	}
+	for _, cs := range [][]node{g.required, g.optional, g.excluded} {
+		for _, c := range cs {
+			g.total += c.cost()
+		}
+	}
+	return g, nil
+}
+
+// clauses compiles sqs, cheapest first
+func (p *Program) clauses(sqs []SubQuery) ([]node, error) {
+	cs := make([]node, 0, len(sqs))
+	for _, sq := range sqs {
+		var c node
+		var err error
+		if sq.Operator == OperatorSubquery {
+			if sq.Query == nil {
+				sq.Query = &Query{}
+			}
+			c, err = p.group(sq.Query)
+		} else {
+			c, err = p.leaf(sq)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	sort.SliceStable(cs, func(i, j int) bool { return cs[i].cost() < cs[j].cost() })
+	return cs, nil
+}
+
+func (g *group) cost() int { return g.total }
+
+func (g *group) match(p *Program, v view) bool {
+	for _, c := range g.required {
+		if !c.match(p, v) {
+			return false
+		}
+	}
+	for _, c := range g.excluded {
+		if c.match(p, v) {
+			return false
+		}
+	}
+	if len(g.required) > 0 {
+		return true
+	}
+	for _, c := range g.optional {
+		if c.match(p, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// leaf is a compiled SubQuery other than a group
+type leaf struct {
+	sq     SubQuery
+	negate bool
+	weight int
+
+	value   string         // the value, folded if case is
+	terms   []string       // words of value
+	prefix  bool           // the last of terms is a prefix
+	pattern *regexp.Regexp // a compiled wildcard
+	fuzzy   []rune         // the runes of value for a fuzzy term
+	re      *regexp.Regexp
+	operand operand
+	csv     *csvSet
+	lower   *operand
+	upper   *operand
+}
+
+func (p *Program) leaf(sq SubQuery) (*leaf, error) {
+	l := &leaf{sq: sq}
+	switch sq.Operator {
+	case OperatorFieldNeg:
+		l.sq.Operator, l.negate = OperatorField, true
+	case OperatorRegexNeg:
+		l.sq.Operator, l.negate = OperatorRegex, true
+	case OperatorRelNE:
+		l.sq.Operator, l.negate = OperatorRelE, true
+	}
+
+	fold := p.m.foldCase
+	l.value = sq.Value
+	if fold {
+		l.value = strings.ToLower(l.value)
+	}
+	switch l.sq.Operator {
+	case OperatorField:
+		l.weight = 2
+		l.terms = tokens(l.value)
+		switch {
+		case sq.Fuzzy > 0:
+			l.weight = 6
+			l.fuzzy = []rune(l.value)
+		case sq.Pattern == PatternWildcard && p.m.textMode == TextSubstring:
+			l.weight = 5
+			l.pattern = compileWildcard("*"+l.value+"*", fold)
+		case sq.Pattern == PatternWildcard:
+			l.weight = 5
+			l.pattern = compileWildcard(l.value, fold)
+		case sq.Pattern == PatternPrefix:
+			l.weight = 3
+			l.prefix = len(l.terms) > 0 && strings.HasSuffix(l.value, l.terms[len(l.terms)-1])
+		}
+	case OperatorProximity:
+		l.weight = 10
+	case OperatorRegex, OperatorRegexMatch:
+		l.weight = 8
+		l.re = sq.Regexp
+		if l.re == nil {
+			var err error
+			if l.re, err = regexp.Compile(sq.Value); err != nil && p.strict {
+				return nil, fmt.Errorf("Invalid regex: %s", err)
+			}
+		}
+	case OperatorCSV:
+		l.weight = 2
+		l.csv = newCSVSet(sq, fold)
+	case OperatorRange:
+		l.weight = 1
+		if r := sq.Range; r != nil {
+			if r.Lower != "" {
+				o := newOperand(r.Lower, r.TypedLower, fold)
+				l.lower = &o
+			}
+			if r.Upper != "" {
+				o := newOperand(r.Upper, r.TypedUpper, fold)
+				l.upper = &o
+			}
+		}
+	default:
+		l.weight = 1
+		var typed interface{}
+		if sq.Typed != nil {
+			typed = sq.Typed.Value
+		}
+		l.operand = newOperand(sq.Value, typed, fold)
+	}
+	if sq.Field == "" {
+		l.weight *= 4
+	}
+	return l, nil
+}
+
+func (l *leaf) cost() int { return l.weight }
+
+func (l *leaf) match(p *Program, v view) bool {
+	return l.anyField(p, v) != l.negate
+}
+
+// anyField reports whether any value of the field of l matches
+func (l *leaf) anyField(p *Program, v view) bool {
+	if v.m != nil {
+		if l.sq.Field == "" {
+			for _, x := range v.m {
+				if l.any(p, x, 0) {
+					return true
+				}
+			}
+			return false
+		}
+		if x, ok := v.m[l.sq.Field]; ok {
+			return l.any(p, x, 0)
+		}
+		v.doc = mapDoc(v.m)
+	}
+	for _, x := range v.doc.values(l.sq.Field) {
+		if l.matchValue(p, x) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyDepth is how deep any descends into maps and slices itself before
+// leaving the rest to flatten, which keeps track of cycles
+const anyDepth = 8
+
+// any reports whether x or any value within it matches, x being depth
+// maps and slices deep
+func (l *leaf) any(p *Program, x interface{}, depth int) bool {
+	switch x := x.(type) {
+	case nil:
+		return false
+	case string:
+		return l.matchString(p, x)
+	case []string:
+		for _, s := range x {
+			if l.matchString(p, s) {
+				return true
+			}
+		}
+		return false
+	case []interface{}:
+		if depth == anyDepth {
+			break
+		}
+		for _, e := range x {
+			if l.any(p, e, depth+1) {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		if depth == anyDepth {
+			break
+		}
+		for _, e := range x {
+			if l.any(p, e, depth+1) {
+				return true
+			}
+		}
+		return false
+	case float64, float32, int, int64, int32, uint, uint64, uint32, bool, time.Time:
+		return l.matchValue(p, x)
+	}
+	for _, e := range flatten(reflect.ValueOf(x), nil, nil) {
+		if l.matchValue(p, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *leaf) matchValue(p *Program, x interface{}) bool {
+	if s, ok := x.(string); ok {
+		return l.matchString(p, s)
+	}
+	switch l.sq.Operator {
+	case OperatorField, OperatorProximity, OperatorRegex, OperatorRegexMatch:
+		return l.matchString(p, text(x))
+	case OperatorCSV:
+		return l.csv.contains(p, x)
+	}
+	return l.compare(func(o *operand) int { return p.compare(x, o) })
+}
+
+func (l *leaf) matchString(p *Program, s string) bool {
+	switch l.sq.Operator {
+	case OperatorField:
+		return l.matchText(p, s)
+	case OperatorProximity:
+		return p.m.matchProximity(l.sq, s)
+	case OperatorRegex, OperatorRegexMatch:
+		return l.re != nil && l.re.MatchString(s)
+	case OperatorCSV:
+		return l.csv.containsString(p, s)
+	}
+	return l.compare(func(o *operand) int { return compareString(s, o, p.m.foldCase) })
+}
+
+// compare applies the relational or range operator of l using cmp, which
+// compares a document value to an operand
+func (l *leaf) compare(cmp func(*operand) int) bool {
+	switch l.sq.Operator {
+	case OperatorExact, OperatorRelE:
+		return cmp(&l.operand) == 0
+	case OperatorRelGT:
+		return cmp(&l.operand) > 0
+	case OperatorRelGTE:
+		return cmp(&l.operand) >= 0
+	case OperatorRelLT:
+		return cmp(&l.operand) < 0
+	case OperatorRelLTE:
+		return cmp(&l.operand) <= 0
+	case OperatorRange:
+		if l.lower != nil {
+			if c := cmp(l.lower); c < 0 || c == 0 && !l.sq.Range.IncludeLower {
+				return false
+			}
+		}
+		if l.upper != nil {
+			if c := cmp(l.upper); c > 0 || c == 0 && !l.sq.Range.IncludeUpper {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// matchText matches a term of operator : against s
+func (l *leaf) matchText(p *Program, s string) bool {
+	fold := p.m.foldCase
+	if l.fuzzy != nil {
+		if p.m.textMode == TextWhole {
+			return l.near(s, fold)
+		}
+		for i := 0; ; {
+			start, end := nextWord(s, i)
+			if start == end {
+				return false
+			}
+			if l.near(s[start:end], fold) {
+				return true
+			}
+			i = end
+		}
+	}
+
+	switch p.m.textMode {
+	case TextSubstring:
+		if l.pattern != nil {
+			return l.pattern.MatchString(s)
+		}
+		return containsText(s, l.value, fold)
+	case TextWhole:
+		switch {
+		case l.pattern != nil:
+			return l.pattern.MatchString(s)
+		case l.sq.Pattern == PatternPrefix:
+			_, ok := prefixText(s, l.value, fold)
+			return ok
+		}
+		return compareText(s, l.value, fold) == 0
+	}
+
+	switch {
+	case l.pattern != nil:
+		for i := 0; ; {
+			start, end := nextWord(s, i)
+			if start == end {
+				return l.pattern.MatchString(s)
+			}
+			if l.pattern.MatchString(s[start:end]) {
+				return true
+			}
+			i = end
+		}
+	case l.sq.Pattern == PatternPrefix && l.value == "":
+		return true
+	case len(l.terms) == 0:
+		return containsText(s, l.value, fold)
+	}
+	for i := 0; ; {
+		start, end := nextWord(s, i)
+		if start == end {
+			return false
+		}
+		if l.sequence(s, start, end, fold) {
+			return true
+		}
+		i = end
+	}
+}
+
+// sequence reports whether l.terms appear in s from the word at start
+func (l *leaf) sequence(s string, start, end int, fold bool) bool {
+	for j, t := range l.terms {
+		if j > 0 {
+			if start, end = nextWord(s, end); start == end {
+				return false
+			}
+		}
+		w := s[start:end]
+		if l.prefix && j == len(l.terms)-1 {
+			if _, ok := prefixText(w, t, fold); !ok {
+				return false
+			}
+		} else if compareText(w, t, fold) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// near reports whether w is within sq.Fuzzy edits of the fuzzy term
+func (l *leaf) near(w string, fold bool) bool {
+	max, n := l.sq.Fuzzy, len(l.fuzzy)
+	if d := utf8.RuneCountInString(w) - n; d > max || -d > max {
+		return false
+	}
+	var buf [2 * 65]int
+	var prev, cur []int
+	if n < 65 {
+		prev, cur = buf[:n+1], buf[65:66+n]
+	} else {
+		prev, cur = make([]int, n+1), make([]int, n+1)
+	}
+	for j := range prev {
+		prev[j] = j
+	}
+	i := 0
+	for _, r := range w {
+		i++
+		if fold {
+			r = unicode.ToLower(r)
+		}
+		cur[0] = i
+		best := i
+		for j := 1; j <= n; j++ {
+			cost := 1
+			if l.fuzzy[j-1] == r {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if cur[j] < best {
+				best = cur[j]
+			}
+		}
+		if best > max {
+			return false
+		}
+		prev, cur = cur, prev
+	}
+	return prev[n] <= max
+}
+
+// operand is a query value prepared for comparison with document values
+type operand struct {
+	text   string // folded if case is
+	num    float64
+	time   time.Time
+	ip     net.IP
+	isNum  bool
+	isTime bool
+	isBool bool
+	bool   bool
+}
+
+// newOperand prepares s, or typed when a Schema converted it, parsing it as
+// each kind of value it can be compared as
+func newOperand(s string, typed interface{}, fold bool) operand {
+	o := operand{text: s}
+	if fold {
+		o.text = strings.ToLower(s)
+	}
+	if f, ok := toFloat(typed); ok {
+		o.num, o.isNum = f, true
+	} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+		o.num, o.isNum = f, true
+	}
+	if t, ok := typed.(time.Time); ok {
+		o.time, o.isTime = t, true
+	} else {
+		o.time, o.isTime = parseTime(s)
+	}
+	if b, ok := typed.(bool); ok {
+		o.bool, o.isBool = b, true
+	} else if b, err := strconv.ParseBool(s); err == nil {
+		o.bool, o.isBool = b, true
+	}
+	if ip, ok := typed.(net.IP); ok {
+		o.ip = ip
+	} else {
+		o.ip = net.ParseIP(s)
+	}
+	return o
+}
+
+// compare compares the document value x to o. Numbers, times, bools and
+// IPs compare as such when o parses as the same kind, other values as text.
+func (p *Program) compare(x interface{}, o *operand) int {
+	if d, ok := toFloat(x); ok {
+		if o.isNum {
+			switch {
+			case d < o.num:
+				return -1
+			case d > o.num:
+				return 1
+			}
+			return 0
+		}
+	} else {
+		switch d := x.(type) {
+		case time.Time:
+			if o.isTime {
+				switch {
+				case d.Before(o.time):
+					return -1
+				case d.After(o.time):
+					return 1
+				}
+				return 0
+			}
+		case bool:
+			if o.isBool {
+				switch {
+				case d == o.bool:
+					return 0
+				case o.bool:
+					return -1
+				}
+				return 1
+			}
+		case net.IP:
+			if o.ip != nil {
+				return compareIP(d, o.ip)
+			}
+		}
+	}
+	return compareString(text(x), o, p.m.foldCase)
+}
+
+// compareString compares the document text s to o: as numbers, times or IPs
+// when s parses as the same kind of value as o, as text otherwise
+func compareString(s string, o *operand, fold bool) int {
+	if o.isNum && isNumber(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			switch {
+			case f < o.num:
+				return -1
+			case f > o.num:
+				return 1
+			}
+			return 0
+		}
+	}
+	if o.isTime && s != "" && isDigit(s[0]) {
+		if t, ok := parseTime(s); ok {
+			switch {
+			case t.Before(o.time):
+				return -1
+			case t.After(o.time):
+				return 1
+			}
+			return 0
+		}
+	}
+	if o.ip != nil && s != "" && (isDigit(s[0]) || strings.IndexByte(s, ':') >= 0) {
+		if ip := net.ParseIP(s); ip != nil {
+			return compareIP(ip, o.ip)
+		}
+	}
+	return compareText(s, o.text, fold)
+}
+
+// isNumber reports whether s is a decimal number, so that parsing it does
+// not fail and allocate an error
+func isNumber(s string) bool {
+	i := 0
+	digits := func() int {
+		n := 0
+		for i < len(s) && isDigit(s[i]) {
+			i, n = i+1, n+1
+		}
+		return n
+	}
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	n := digits()
+	if i < len(s) && s[i] == '.' {
+		i++
+		n += digits()
+	}
+	if n == 0 {
+		return false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func compareIP(a, b net.IP) int {
+	a, b = a.To16(), b.To16()
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// csvSetSize is the number of values from which a csvSet looks up text in
+// a map rather than comparing each value, which can allocate when folding
+const csvSetSize = 8
+
+// csvSet holds the values of an OperatorCSV term
+type csvSet struct {
+	operands []operand
+	texts    map[string]bool
+	nums     map[float64]bool
+	parsed   bool // some values are numbers, times or IPs
+}
+
+func newCSVSet(sq SubQuery, fold bool) *csvSet {
+	var typed []interface{}
+	if sq.Typed != nil {
+		typed = sq.Typed.Values
+	}
+	values := strings.Split(sq.Value, ",")
+	s := &csvSet{
+		operands: make([]operand, len(values)),
+		nums:     make(map[float64]bool),
+	}
+	for i, v := range values {
+		var t interface{}
+		if i < len(typed) {
+			t = typed[i]
+		}
+		o := newOperand(strings.TrimSpace(v), t, fold)
+		if o.isNum {
+			s.nums[o.num] = true
+		}
+		s.parsed = s.parsed || o.isNum || o.isTime || o.ip != nil
+		s.operands[i] = o
+	}
+	if len(values) >= csvSetSize {
+		s.texts = make(map[string]bool, len(values))
+		for _, o := range s.operands {
+			s.texts[o.text] = true
+		}
+	}
+	return s
+}
+
+func (s *csvSet) containsString(p *Program, v string) bool {
+	if s.texts != nil {
+		t := v
+		if p.m.foldCase {
+			t = strings.ToLower(t)
+		}
+		if s.texts[t] || !s.parsed {
+			return s.texts[t]
+		}
+	}
+	for i := range s.operands {
+		if compareString(v, &s.operands[i], p.m.foldCase) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *csvSet) contains(p *Program, x interface{}) bool {
+	if f, ok := toFloat(x); ok && len(s.nums) > 0 {
+		return s.nums[f]
+	}
+	for i := range s.operands {
+		if p.compare(x, &s.operands[i]) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// compileWildcard returns a regex matching the whole of a text as the
+// wildcard pattern does
+func compileWildcard(pattern string, fold bool) *regexp.Regexp {
+	var b strings.Builder
+	if fold {
+		b.WriteString("(?i)")
+	}
+	b.WriteString(`(?s)^(?:`)
+	literal := 0
+	flush := func(i int) {
+		b.WriteString(regexp.QuoteMeta(pattern[literal:i]))
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+			flush(i)
+			if pattern[i] == '*' {
+				b.WriteString(`.*`)
+			} else {
+				b.WriteString(`.`)
+			}
+			literal = i + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				flush(i)
+				literal = i + 1
+				i++
+			}
+		}
+	}
+	flush(len(pattern))
+	b.WriteString(`)$`)
+	return regexp.MustCompile(b.String())
+}
+
+// nextWord returns the bounds of the first word of letters and digits in s
+// from i, both len(s) if there is none
+func nextWord(s string, i int) (start, end int) {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			break
+		}
+		i += size
+	}
+	start = i
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		i += size
+	}
+	return start, i
+}
+
+// prefixText reports whether s starts with prefix, folding case by rune if
+// fold is set, and the length of that start of s
+func prefixText(s, prefix string, fold bool) (int, bool) {
+	if !fold {
+		return len(prefix), strings.HasPrefix(s, prefix)
+	}
+	i := 0
+	for _, pr := range prefix {
+		if i == len(s) {
+			return i, false
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r != pr && unicode.ToLower(r) != unicode.ToLower(pr) {
+			return i, false
+		}
+		i += size
+	}
+	return i, true
+}
+
+// containsText reports whether sub is within s, folding case if fold is set
+func containsText(s, sub string, fold bool) bool {
+	if !fold {
+		return strings.Contains(s, sub)
+	}
+	for i := 0; i <= len(s); {
+		if _, ok := prefixText(s[i:], sub, true); ok {
+			return true
+		}
+		if i == len(s) {
+			break
+		}
+		_, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+	}
+	return false
+}
+
+// compareText compares a and b as strings.Compare would once lower-cased
+// if fold is set
+func compareText(a, b string, fold bool) int {
+	if !fold {
+		return strings.Compare(a, b)
+	}
+	for a != "" && b != "" {
+		ra, sa := utf8.DecodeRuneInString(a)
+		rb, sb := utf8.DecodeRuneInString(b)
+		if ra, rb = unicode.ToLower(ra), unicode.ToLower(rb); ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+		a, b = a[sa:], b[sb:]
+	}
+	switch {
+	case a != "":
+		return 1
+	case b != "":
+		return -1
+	}
+	return 0
+}
@@ -0,0 +1,122 @@
+package searchquery
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrorCode identifies the kind of failure reported by a ParseError
+type ErrorCode int
+
+const (
+	ErrorUnexpected ErrorCode = iota
+	ErrorUnbalancedParen
+	ErrorMixedBoolean
+	ErrorNegatedOrOperand
+	ErrorFieldInsideField
+	ErrorNoPositiveTerm
+	ErrorInvalidPrefix
+	ErrorUnknownField
+	ErrorTooLong
+	ErrorTooDeep
+	ErrorTooManyClauses
+	ErrorRegexTooLong
+	ErrorRegexTooComplex
+	ErrorInvalidRegex
+	ErrorInvalidOperator
+	ErrorInvalidValue
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorUnexpected:       "Unexpected",
+	ErrorUnbalancedParen:  "UnbalancedParen",
+	ErrorMixedBoolean:     "MixedBoolean",
+	ErrorNegatedOrOperand: "NegatedOrOperand",
+	ErrorFieldInsideField: "FieldInsideField",
+	ErrorNoPositiveTerm:   "NoPositiveTerm",
+	ErrorInvalidPrefix:    "InvalidPrefix",
+	ErrorUnknownField:     "UnknownField",
+	ErrorTooLong:          "TooLong",
+	ErrorTooDeep:          "TooDeep",
+	ErrorTooManyClauses:   "TooManyClauses",
+	ErrorRegexTooLong:     "RegexTooLong",
+	ErrorRegexTooComplex:  "RegexTooComplex",
+	ErrorInvalidRegex:     "InvalidRegex",
+	ErrorInvalidOperator:  "InvalidOperator",
+	ErrorInvalidValue:     "InvalidValue",
+}
+
+func (c ErrorCode) String() string {
+	if s, ok := errorCodeNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(c))
+}
+
+// Descriptions used in ParseError.Expected
+const (
+	ExpectTerm       = "term"
+	ExpectField      = "field"
+	ExpectOpenParen  = "("
+	ExpectCloseParen = ")"
+	ExpectTo         = rangeTo
+	ExpectCloseRange = "] or }"
+	ExpectAnd        = "AND"
+	ExpectOr         = "OR"
+	ExpectEnd        = "end of query"
+)
+
+// IsLimit reports whether c is the code of an exceeded parser limit
+func (c ErrorCode) IsLimit() bool {
+	return c >= ErrorTooLong && c <= ErrorRegexTooComplex
+}
+
+// ParseError is returned by Parse and ParseGreedy for every malformed query.
+// Offset is a byte offset into the original input; Line and Column are
+// 1-based, with Column counted in runes.
+type ParseError struct {
+	Code     ErrorCode
+	Msg      string
+	Offset   int
+	Line     int
+	Column   int
+	Snippet  string
+	Expected []string
+}
+
+const maxSnippet = 32
+
+func newParseError(input string, offset int, code ErrorCode, expected []string, format string, args ...interface{}) *ParseError {
+	e := &ParseError{
+		Code:     code,
+		Msg:      fmt.Sprintf(format, args...),
+		Offset:   offset,
+		Line:     1 + strings.Count(input[:offset], "\n"),
+		Snippet:  snippet(input[offset:]),
+		Expected: expected,
+	}
+	lineStart := strings.LastIndex(input[:offset], "\n") + 1
+	e.Column = 1 + utf8.RuneCountInString(input[lineStart:offset])
+	return e
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+}
+
+// snippet returns the word at the start of s, capped to maxSnippet bytes
+// without splitting a rune
+func snippet(s string) string {
+	if i := strings.IndexAny(s, " \t\n\f\r"); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) <= maxSnippet {
+		return s
+	}
+	n := maxSnippet
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
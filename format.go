@@ -0,0 +1,255 @@
+package searchquery
+
+import (
+	"strconv"
+	"strings"
+)
+
+// String returns the query in canonical form: optional clauses joined by
+// OR, then required and excluded clauses with their prefix. Parse reads it
+// back into an equal Query, and so does ParseGreedy unless a Query has a
+// single optional clause, which ParseGreedy only produces from a dangling
+// OR.
+func (q Query) String() string {
+	return q.string(SubQuery{Operator: OperatorField})
+}
+
+func (sq SubQuery) String() string {
+	return sq.string(SubQuery{Operator: OperatorField})
+}
+
+// string renders the clauses of q relative to the field and operator they
+// inherit from an enclosing group, given as ctx
+func (q Query) string(ctx SubQuery) string {
+	optional := make([]string, len(q.Optional))
+	for i, sq := range q.Optional {
+		optional[i] = PrefixOptional + sq.clause(ctx, i == 0)
+	}
+	buf := make([]string, 0, 1+len(q.Required)+len(q.Excluded))
+	if len(optional) > 0 {
+		buf = append(buf, strings.Join(optional, " OR "))
+	}
+	for _, sq := range q.Required {
+		buf = append(buf, PrefixRequired+sq.clause(ctx, len(buf) == 0))
+	}
+	for _, sq := range q.Excluded {
+		buf = append(buf, PrefixExcluded+sq.clause(ctx, len(buf) == 0))
+	}
+	return strings.Join(buf, " ")
+}
+
+func (sq SubQuery) string(ctx SubQuery) string {
+	return sq.clause(ctx, true)
+}
+
+// clause renders sq, following another clause unless first
+func (sq SubQuery) clause(ctx SubQuery, first bool) string {
+	if sq.Boost != 0 {
+		return sq.term(ctx, first) + "^" + strconv.FormatFloat(sq.Boost, 'f', -1, 64)
+	}
+	return sq.term(ctx, first)
+}
+
+// term renders sq without its boost
+func (sq SubQuery) term(ctx SubQuery, first bool) string {
+	if sq.Operator == OperatorSubquery {
+		if sq.Field == ctx.Field {
+			return "(" + sq.Query.string(ctx) + ")"
+		}
+		group := sq.Query.groupTerm()
+		group.Field = sq.Field
+		return formatField(sq.Field) + group.operator() + "(" + sq.Query.string(group) + ")"
+	}
+	if sq.Operator == OperatorRange {
+		if sq.Field == ctx.Field {
+			return sq.Range.String()
+		}
+		return formatField(sq.Field) + OperatorField + sq.Range.String()
+	}
+	value := sq.value()
+	if sq.Field == ctx.Field && value != "" {
+		if sq.Operator == ctx.Operator && sq.Slop == ctx.Slop {
+			if !first && sq.Quote == QuoteNone && readsAsBoolean(value) {
+				// AND or OR right after another clause joins the two
+				return `\` + value
+			}
+			return value
+		}
+		if sq.Operator == OperatorProximity && sq.Quote != QuoteNone && (ctx.Operator == OperatorField || ctx.Operator == OperatorProximity) {
+			return value + sq.operator()
+		}
+	}
+	op := sq.operator()
+	if sq.Quote == QuoteNone && extendsOperator(sq.Field, op, value) {
+		value = `\` + value
+	}
+	return formatField(sq.Field) + op + value
+}
+
+// readsAsBoolean reports whether the lexer would take the start of v for
+// an AND or OR keyword when it follows another clause
+func readsAsBoolean(v string) bool {
+	l := lexer{Parser: formatParser, input: v}
+	return l.keyword(l.keywords.And) != "" || l.keyword(l.keywords.Or) != ""
+}
+
+// formatField writes a field name, quoting it unless the default syntax
+// reads it unquoted
+func formatField(field string) string {
+	l := lexer{Parser: defaultParser, input: field}
+	if l.fieldLen(field) == len(field) && l.keyword(l.keywords.Not) == "" {
+		return field
+	}
+	return quoteValue(field, QuoteDouble)
+}
+
+// value returns Value as written in a query
+func (sq SubQuery) value() string {
+	switch {
+	case sq.Quote != QuoteNone:
+		return quoteValue(sq.Value, sq.Quote)
+	case sq.Pattern == PatternPrefix:
+		return escapeBare(withSuffix(sq.Value, "*"))
+	case sq.Pattern == PatternWildcard:
+		return escapeBare(splitPattern(sq.Value))
+	case sq.Fuzzy > 0:
+		return escapeBare(withSuffix(sq.Value, "~"+strconv.Itoa(sq.Fuzzy)))
+	case hasPattern(sq.Operator):
+		return escapeBare(sq.Value, make([]bool, len(sq.Value)))
+	}
+	return escapeBare(sq.Value, nil)
+}
+
+// withSuffix appends suffix to v, marking it as syntax for escapeBare
+func withSuffix(v, suffix string) (string, []bool) {
+	syntax := make([]bool, len(v)+len(suffix))
+	for i := len(v); i < len(syntax); i++ {
+		syntax[i] = true
+	}
+	return v + suffix, syntax
+}
+
+// operator returns the operator as written in a query
+func (sq SubQuery) operator() string {
+	if sq.Operator == OperatorProximity {
+		return "~" + strconv.Itoa(sq.Slop)
+	}
+	return string(sq.Operator)
+}
+
+// groupTerm returns the operator the terms of a fielded group inherit. Its
+// terms all share it, except ranges and phrases given a proximity suffix.
+func (q Query) groupTerm() (term SubQuery) {
+	term.Operator = OperatorField
+	var walk func(q Query) bool
+	walk = func(q Query) bool {
+		for _, clauses := range [][]SubQuery{q.Required, q.Optional, q.Excluded} {
+			for _, sq := range clauses {
+				switch {
+				case sq.Operator == OperatorSubquery:
+					if sq.Query != nil && walk(*sq.Query) {
+						return true
+					}
+				case sq.Operator == OperatorRange:
+				case sq.Operator != OperatorProximity:
+					term.Operator, term.Slop = sq.Operator, 0
+					return true
+				case sq.Quote == QuoteNone:
+					term.Operator, term.Slop = sq.Operator, sq.Slop
+				}
+			}
+		}
+		return false
+	}
+	walk(q)
+	return
+}
+
+// extendsOperator reports whether writing v right after op would change
+// the operator the lexer reads, as in date< followed by =x
+func extendsOperator(field string, op string, v string) bool {
+	if v == "" || v[0] == '\\' {
+		return false
+	}
+	s := op + v
+	if field == "" {
+		return matchOperator(s, noFieldOperatorList) != op
+	}
+	if p := matchProximity(s); p != "" {
+		return p != op
+	}
+	return matchOperator(s, fieldOperatorList) != op
+}
+
+// quoteValue surrounds v with quote, escaping backslashes and the quote.
+// Unquoted values are escaped with escapeBare.
+func quoteValue(v string, quote Quote) string {
+	if quote == QuoteNone {
+		return escapeBare(v, nil)
+	}
+	q := string(quote)
+	if strings.Contains(v, `\`) || strings.Contains(v, q) {
+		v = strings.NewReplacer(`\`, `\\`, q, `\`+q).Replace(v)
+	}
+	return q + v + q
+}
+
+// formatParser is the syntax escapeBare guards against: the default one
+// with the widest field names, so that values read back with any of the
+// FieldRunes sets
+var formatParser = NewParser(WithFieldRunes(FieldRunesPath))
+
+// escapeBare escapes the characters of an unquoted value that would end
+// the term, be read as a boost or, at its start, be read as a prefix,
+// quote, range, field or operator. Like Lucene, it does so with a
+// backslash. Unless syntax is nil the value is classified when parsed:
+// characters marked in syntax, such as wildcards, are left as they are,
+// while other * and ? are escaped, and so is a trailing fuzzy suffix.
+func escapeBare(v string, syntax []bool) string {
+	escape := func(i int) bool {
+		switch c := v[i]; {
+		case syntax != nil && syntax[i]:
+			return false
+		case c == '\\' || c == '(' || c == ')' || isSpace(c):
+			return true
+		case syntax != nil && (c == '*' || c == '?'):
+			return true
+		case syntax != nil && c == '~':
+			return i > 0 && fuzzyLen(v[i:]) == len(v)-i
+		case c == '^':
+			// A boost, or at the start one ending a field~N before it
+			return i > 0 && matchBoost(v[i:]) == v[i:] || i == 0 && matchBoost(v) != ""
+		case i > 0:
+			return false
+		case c == '+' || c == '-' || c == '"' || c == '\'' || c == '[' || c == '{':
+			return true
+		}
+		return false
+	}
+	// A keyword, field name or operator at the start of the value
+	first := -1
+	l := lexer{Parser: formatParser, input: v}
+	if l.keyword(l.keywords.Not) != "" || matchOperator(v, noFieldOperatorList) != "" {
+		first = 0
+	} else if n := l.fieldLen(v); n > 0 && n < len(v) && (matchProximity(v[n:]) != "" || matchOperator(v[n:], fieldOperatorList) != "") {
+		first = n
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if i == first && (syntax == nil || !syntax[i]) || escape(i) {
+			if b.Len() == 0 && i > 0 {
+				b.Grow(len(v) + 4)
+				b.WriteString(v[:i])
+			}
+			b.WriteByte('\\')
+		} else if b.Len() == 0 {
+			continue
+		}
+		b.WriteByte(v[i])
+	}
+	if b.Len() == 0 {
+		return v
+	}
+	return b.String()
+}
@@ -0,0 +1,211 @@
+package searchquery
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Index is a small in-memory inverted index of documents made of text
+// fields, meant as a reference backend for tests and small deployments.
+// Search gives the same results as a default Matcher over the documents.
+//
+// Terms and phrases are looked up in the index; other clauses are checked
+// against each document holding the field. An Index is safe for concurrent
+// use.
+type Index struct {
+	m *Matcher
+
+	mu       sync.RWMutex
+	docs     map[string]map[string]string
+	postings map[string]map[string]map[string][]int // field, word and ID to positions
+}
+
+// NewIndex returns an empty Index
+func NewIndex() *Index {
+	return &Index{
+		m:        NewMatcher(),
+		docs:     make(map[string]map[string]string),
+		postings: make(map[string]map[string]map[string][]int),
+	}
+}
+
+// Add indexes the fields of a document under id, replacing any document
+// already indexed under it
+func (x *Index) Add(id string, fields map[string]string) {
+	doc := make(map[string]string, len(fields))
+	for field, v := range fields {
+		doc[field] = v
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(id)
+	x.docs[id] = doc
+	for field, v := range doc {
+		words := x.postings[field]
+		if words == nil {
+			words = make(map[string]map[string][]int)
+			x.postings[field] = words
+		}
+		for pos, w := range tokens(strings.ToLower(v)) {
+			ids := words[w]
+			if ids == nil {
+				ids = make(map[string][]int)
+				words[w] = ids
+			}
+			ids[id] = append(ids[id], pos)
+		}
+	}
+}
+
+// Remove deletes the document indexed under id, reporting whether there
+// was one
+func (x *Index) Remove(id string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.remove(id)
+}
+
+func (x *Index) remove(id string) bool {
+	doc, ok := x.docs[id]
+	if !ok {
+		return false
+	}
+	delete(x.docs, id)
+	for field, v := range doc {
+		words := x.postings[field]
+		for _, w := range tokens(strings.ToLower(v)) {
+			if ids := words[w]; ids != nil {
+				if delete(ids, id); len(ids) == 0 {
+					delete(words, w)
+				}
+			}
+		}
+		if len(words) == 0 {
+			delete(x.postings, field)
+		}
+	}
+	return true
+}
+
+// Len returns the number of indexed documents
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs)
+}
+
+// Search returns the sorted IDs of the documents matching q
+func (x *Index) Search(q *Query) []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	ids := make([]string, 0)
+	for id := range x.search(q) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (x *Index) search(q *Query) map[string]bool {
+	var ids map[string]bool
+	if len(q.Required) > 0 {
+		for i, sq := range q.Required {
+			set := x.subQuery(sq)
+			if i == 0 {
+				ids = set
+				continue
+			}
+			for id := range ids {
+				if !set[id] {
+					delete(ids, id)
+				}
+			}
+		}
+	} else {
+		ids = make(map[string]bool)
+		for _, sq := range q.Optional {
+			for id := range x.subQuery(sq) {
+				ids[id] = true
+			}
+		}
+	}
+	for _, sq := range q.Excluded {
+		for id := range x.subQuery(sq) {
+			delete(ids, id)
+		}
+	}
+	return ids
+}
+
+func (x *Index) subQuery(sq SubQuery) map[string]bool {
+	switch sq.Operator {
+	case OperatorSubquery:
+		if sq.Query == nil {
+			return make(map[string]bool)
+		}
+		return x.search(sq.Query)
+	case OperatorFieldNeg, OperatorRegexNeg, OperatorRelNE:
+		// Documents without a match, including those without the field
+		switch sq.Operator {
+		case OperatorFieldNeg:
+			sq.Operator = OperatorField
+		case OperatorRegexNeg:
+			sq.Operator = OperatorRegex
+		default:
+			sq.Operator = OperatorRelE
+		}
+		matched := x.subQuery(sq)
+		ids := make(map[string]bool, len(x.docs)-len(matched))
+		for id := range x.docs {
+			if !matched[id] {
+				ids[id] = true
+			}
+		}
+		return ids
+	}
+
+	ids := make(map[string]bool)
+	if sq.Operator == OperatorField && sq.Pattern == PatternNone && sq.Fuzzy == 0 {
+		if terms := tokens(strings.ToLower(sq.Value)); len(terms) > 0 {
+			for field, words := range x.postings {
+				if sq.Field == "" || field == sq.Field {
+					matchPhrase(words, terms, ids)
+				}
+			}
+			return ids
+		}
+	}
+	p := &Program{m: x.m}
+	l, _ := p.leaf(sq)
+	for id, doc := range x.docs {
+		for field, v := range doc {
+			if (sq.Field == "" || field == sq.Field) && l.matchString(p, v) {
+				ids[id] = true
+				break
+			}
+		}
+	}
+	return ids
+}
+
+// matchPhrase adds to ids the documents in which terms follow each other
+func matchPhrase(words map[string]map[string][]int, terms []string, ids map[string]bool) {
+	for id, positions := range words[terms[0]] {
+		if ids[id] {
+			continue
+		}
+	next:
+		for _, start := range positions {
+			for i, t := range terms[1:] {
+				p := words[t][id]
+				if j := sort.SearchInts(p, start+i+1); j == len(p) || p[j] != start+i+1 {
+					continue next
+				}
+			}
+			ids[id] = true
+			break
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package searchquery
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// JSON schema
+//
+// A Query is an object with up to three arrays of clauses, each omitted
+// when empty:
+//
+//	{"required": [...], "optional": [...], "excluded": [...]}
+//
+// A clause (SubQuery) is an object:
+//
+//	{"field": "date", "operator": "gte", "quote": "single", "value": "01.01.2001"}
+//	{"operator": "subquery", "query": {"optional": [...]}}
+//	{"field": "date", "operator": "range", "range": {"lower": "2001", "include_lower": true}}
+//
+// "field" is omitted when empty, "quote" when it is "none" and "pattern"
+// when it is exact; otherwise it is "prefix" or "wildcard". "fuzzy", the
+// edit distance of a fuzzy term, is omitted when 0. "operator"
+// is one of the names in operatorNames; "proximity" (~N) requires an
+// integer "distance", the Slop. Subqueries carry a nested "query" and
+// ranges a "range" with an empty bound for *; neither has a quote or value.
+// "boost" is omitted when it is the default. A clause without a field
+// takes one of the operators a query can write without one: field, regex,
+// regex_match, not_regex, csv, subquery and range, or proximity on a
+// quoted value.
+//
+// Unmarshaling rejects unknown keys, unknown names and inconsistent
+// clauses, and requires every query to have a required or optional clause,
+// the same rule Parse applies.
+
+var operatorNames = map[Operator]string{
+	OperatorCSV:        "csv",
+	OperatorExact:      "exact",
+	OperatorField:      "field",
+	OperatorFieldNeg:   "not_field",
+	OperatorProximity:  "proximity",
+	OperatorRange:      "range",
+	OperatorRegex:      "regex",
+	OperatorRegexMatch: "regex_match",
+	OperatorRegexNeg:   "not_regex",
+	OperatorRelE:       "eq",
+	OperatorRelGT:      "gt",
+	OperatorRelGTE:     "gte",
+	OperatorRelLT:      "lt",
+	OperatorRelLTE:     "lte",
+	OperatorRelNE:      "ne",
+	OperatorSubquery:   "subquery",
+}
+
+var quoteNames = map[Quote]string{
+	QuoteNone:   "none",
+	QuoteSingle: "single",
+	QuoteDouble: "double",
+}
+
+var (
+	operatorsByName = make(map[string]Operator, len(operatorNames))
+	quotesByName    = make(map[string]Quote, len(quoteNames))
+)
+
+func init() {
+	for op, name := range operatorNames {
+		operatorsByName[name] = op
+	}
+	for q, name := range quoteNames {
+		quotesByName[name] = q
+	}
+}
+
+type jsonQuery struct {
+	Required []SubQuery `json:"required,omitempty"`
+	Optional []SubQuery `json:"optional,omitempty"`
+	Excluded []SubQuery `json:"excluded,omitempty"`
+}
+
+type jsonSubQuery struct {
+	Field    string  `json:"field,omitempty"`
+	Operator string  `json:"operator"`
+	Distance *int    `json:"distance,omitempty"`
+	Boost    float64 `json:"boost,omitempty"`
+	Quote    string  `json:"quote,omitempty"`
+	Value    string  `json:"value,omitempty"`
+	Pattern  string  `json:"pattern,omitempty"`
+	Fuzzy    int     `json:"fuzzy,omitempty"`
+	Range    *Range  `json:"range,omitempty"`
+	Query    *Query  `json:"query,omitempty"`
+}
+
+func (q Query) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonQuery{
+		Required: q.Required,
+		Optional: q.Optional,
+		Excluded: q.Excluded,
+	})
+}
+
+func (q *Query) UnmarshalJSON(data []byte) (err error) {
+	var jq jsonQuery
+	if err = decodeStrict(data, &jq); err != nil {
+		return
+	}
+	if len(jq.Required) == 0 && len(jq.Optional) == 0 {
+		return fmt.Errorf("No positive value in query")
+	}
+	*q = Query{
+		Required: jq.Required,
+		Optional: jq.Optional,
+		Excluded: jq.Excluded,
+	}
+	return
+}
+
+func (sq SubQuery) MarshalJSON() ([]byte, error) {
+	js := jsonSubQuery{
+		Field:   sq.Field,
+		Value:   sq.Value,
+		Pattern: string(sq.Pattern),
+		Fuzzy:   sq.Fuzzy,
+		Boost:   sq.Boost,
+		Range:   sq.Range,
+		Query:   sq.Query,
+	}
+	name, ok := operatorNames[sq.Operator]
+	if !ok {
+		return nil, fmt.Errorf("Unknown operator: %s", sq.Operator)
+	}
+	js.Operator = name
+	if sq.Operator == OperatorProximity {
+		js.Distance = &sq.Slop
+	} else if sq.Slop != 0 {
+		return nil, fmt.Errorf("Slop is only valid with operator %s", OperatorProximity)
+	}
+	if name, ok = quoteNames[sq.Quote]; !ok {
+		return nil, fmt.Errorf("Unknown quote: %s", sq.Quote)
+	}
+	if sq.Quote != QuoteNone {
+		js.Quote = name
+	}
+	if err := validPattern(sq); err != nil {
+		return nil, err
+	}
+	if sq.Boost < 0 {
+		return nil, fmt.Errorf("Boost must be positive: %v", sq.Boost)
+	}
+	if (sq.Operator == OperatorSubquery) != (sq.Query != nil) {
+		return nil, fmt.Errorf("Query must be set for operator %s only", OperatorSubquery)
+	}
+	if (sq.Operator == OperatorRange) != (sq.Range != nil) {
+		return nil, fmt.Errorf("Range must be set for operator %s only", OperatorRange)
+	}
+	return json.Marshal(js)
+}
+
+func (sq *SubQuery) UnmarshalJSON(data []byte) (err error) {
+	var js jsonSubQuery
+	if err = decodeStrict(data, &js); err != nil {
+		return
+	}
+	v := SubQuery{
+		Field:   js.Field,
+		Value:   js.Value,
+		Pattern: Pattern(js.Pattern),
+		Fuzzy:   js.Fuzzy,
+		Boost:   js.Boost,
+		Range:   js.Range,
+		Query:   js.Query,
+	}
+
+	op, ok := operatorsByName[js.Operator]
+	if !ok {
+		return fmt.Errorf("Unknown operator: %q", js.Operator)
+	}
+	v.Operator = op
+	if op == OperatorProximity {
+		if js.Distance == nil || *js.Distance < 0 {
+			return fmt.Errorf("Operator %s requires a non-negative distance", js.Operator)
+		}
+		v.Slop = *js.Distance
+	} else if js.Distance != nil {
+		return fmt.Errorf("Distance is only valid with operator %s", operatorNames[OperatorProximity])
+	}
+
+	if js.Quote != "" {
+		q, ok := quotesByName[js.Quote]
+		if !ok {
+			return fmt.Errorf("Unknown quote: %q", js.Quote)
+		}
+		v.Quote = q
+	}
+	if v.Field == "" && !fieldless(v) {
+		return fmt.Errorf("Operator %s requires a field", js.Operator)
+	}
+	if err = validPattern(v); err != nil {
+		return
+	}
+	if v.Boost < 0 {
+		return fmt.Errorf("Boost must be positive: %v", v.Boost)
+	}
+
+	if v.Operator == OperatorSubquery {
+		if v.Query == nil {
+			return fmt.Errorf("Operator %s requires a query", js.Operator)
+		}
+		if v.Value != "" || v.Quote != QuoteNone {
+			return fmt.Errorf("Operator %s cannot have a value or quote", js.Operator)
+		}
+		if err = sameField(v); err != nil {
+			return
+		}
+	} else if v.Query != nil {
+		return fmt.Errorf("Operator %s cannot have a query", js.Operator)
+	}
+	if v.Operator == OperatorRange {
+		if v.Range == nil {
+			return fmt.Errorf("Operator %s requires a range", js.Operator)
+		}
+		if v.Value != "" || v.Quote != QuoteNone {
+			return fmt.Errorf("Operator %s cannot have a value or quote", js.Operator)
+		}
+	} else if v.Range != nil {
+		return fmt.Errorf("Operator %s cannot have a range", js.Operator)
+	}
+	*sq = v
+	return
+}
+
+// sameField reports an error if a clause of the fielded group sq has a
+// field of its own, which a query cannot express
+func sameField(sq SubQuery) error {
+	if sq.Field == "" {
+		return nil
+	}
+	for _, clauses := range [][]SubQuery{sq.Query.Required, sq.Query.Optional, sq.Query.Excluded} {
+		for _, c := range clauses {
+			if c.Field != sq.Field {
+				return fmt.Errorf("Field '%s' inside '%s'", c.Field, sq.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// fieldless reports whether sq can be written without a field
+func fieldless(sq SubQuery) bool {
+	switch sq.Operator {
+	case OperatorSubquery, OperatorRange:
+		return true
+	case OperatorProximity:
+		return sq.Quote != QuoteNone
+	}
+	return matchOperator(string(sq.Operator), noFieldOperatorList) == string(sq.Operator)
+}
+
+func validPattern(sq SubQuery) error {
+	if sq.Fuzzy < 0 {
+		return fmt.Errorf("Fuzzy must not be negative: %d", sq.Fuzzy)
+	}
+	if sq.Fuzzy > 0 && (sq.Pattern != PatternNone || sq.Quote != QuoteNone || !hasPattern(sq.Operator)) {
+		return fmt.Errorf("Fuzzy requires an exact unquoted value and operator %s or %s", OperatorField, OperatorFieldNeg)
+	}
+	switch sq.Pattern {
+	case PatternNone:
+		return nil
+	case PatternPrefix, PatternWildcard:
+	default:
+		return fmt.Errorf("Unknown pattern: %q", sq.Pattern)
+	}
+	if sq.Quote != QuoteNone || !hasPattern(sq.Operator) {
+		return fmt.Errorf("Pattern %s requires an unquoted value and operator %s or %s", sq.Pattern, OperatorField, OperatorFieldNeg)
+	}
+	return nil
+}
+
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
@@ -0,0 +1,543 @@
+package searchquery
+
+import (
+	"fmt"
+	"strings"
+)
+
+type TokenKind int
+
+const (
+	TokenPrefix TokenKind = iota // + or -
+	TokenNot                     // NOT and its translations
+	TokenField
+	TokenOperator
+	TokenTerm
+	TokenOpenParen
+	TokenCloseParen
+	TokenAnd
+	TokenOr
+	TokenSlop       // ~N after a phrase
+	TokenOpenRange  // [ or {
+	TokenTo         // TO between range bounds
+	TokenCloseRange // ] or }
+	TokenBoost      // ^N after a term, phrase, range or group
+	TokenFuzzy      // ~ or ~N after a bare term
+)
+
+var tokenKindNames = map[TokenKind]string{
+	TokenPrefix:     "Prefix",
+	TokenNot:        "Not",
+	TokenField:      "Field",
+	TokenOperator:   "Operator",
+	TokenTerm:       "Term",
+	TokenOpenParen:  "OpenParen",
+	TokenCloseParen: "CloseParen",
+	TokenAnd:        "And",
+	TokenOr:         "Or",
+	TokenSlop:       "Slop",
+	TokenOpenRange:  "OpenRange",
+	TokenTo:         "To",
+	TokenCloseRange: "CloseRange",
+	TokenBoost:      "Boost",
+	TokenFuzzy:      "Fuzzy",
+}
+
+func (k TokenKind) String() string {
+	if s, ok := tokenKindNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
+// Token is a lexeme of the query grammar. Text is the source text between
+// the byte offsets Start and End; for fields and terms Value holds the
+// unquoted value and Quote the quote character used.
+type Token struct {
+	Kind       TokenKind
+	Text       string
+	Value      string
+	Quote      Quote
+	Start, End int
+}
+
+var (
+	fieldOperatorList   = []string{"==", "<=", ">=", "!=", "!:", "=~", "!~", ":", "=", "<", ">", "~", "#"}
+	noFieldOperatorList = []string{"=~", "!~", "~", ":", "#"}
+)
+
+// lexer splits a query into tokens one clause at a time. Which tokens are
+// possible depends on what came before them: boolean keywords are only
+// recognized after a term or a closing parenthesis, and prefixes only at the
+// start of a clause.
+type lexer struct {
+	*Parser
+	input  string
+	pos    int
+	tokens []Token
+	buf    [10]Token // backs tokens while parsing clause by clause
+}
+
+// Lex splits s into tokens using the same rules as Parse, so that editors
+// and highlighters agree with the parser. Whitespace is not returned. All
+// tokens are returned even when the parentheses do not balance, in which
+// case err is a *ParseError pointing at the offending parenthesis.
+func Lex(s string) ([]Token, error) {
+	return defaultParser.Lex(s)
+}
+
+// Lex splits s into tokens using the same rules as p.Parse
+func (p *Parser) Lex(s string) (tokens []Token, err error) {
+	l := p.newLexer(s)
+	for l.pos < len(l.input) {
+		l.clause()
+	}
+	tokens = l.tokens
+	var open []int
+	for i := range tokens {
+		t := &tokens[i]
+		t.Text = s[t.Start:t.End]
+		switch t.Kind {
+		case TokenOpenParen:
+			open = append(open, t.Start)
+		case TokenCloseParen:
+			if len(open) == 0 {
+				if err == nil {
+					err = newParseError(s, t.Start, ErrorUnbalancedParen, []string{ExpectEnd}, "Unexpected )")
+				}
+				continue
+			}
+			open = open[:len(open)-1]
+		}
+	}
+	if len(open) > 0 && err == nil {
+		err = newParseError(s, open[len(open)-1], ErrorUnbalancedParen, []string{ExpectCloseParen}, "No matching )")
+	}
+	return
+}
+
+func (p *Parser) newLexer(s string) lexer {
+	l := lexer{Parser: p, input: s}
+	l.skipSpace()
+	return l
+}
+
+// more lexes the next clause into a fresh Token buffer, reporting false at
+// the end of input
+func (l *lexer) more() bool {
+	l.tokens = l.buf[:0]
+	if l.pos >= len(l.input) {
+		return false
+	}
+	l.clause()
+	return true
+}
+
+func (l *lexer) emit(kind TokenKind, text string, quote Quote, start int) {
+	l.tokens = append(l.tokens, Token{
+		Kind:  kind,
+		Value: text,
+		Quote: quote,
+		Start: start,
+		End:   l.pos,
+	})
+}
+
+func (l *lexer) skipSpace() {
+	for l.pos < len(l.input) && isSpace(l.input[l.pos]) {
+		l.pos++
+	}
+}
+
+func (l *lexer) clause() {
+	start := l.pos
+	if l.input[l.pos] == ')' {
+		l.pos++
+		l.emit(TokenCloseParen, ")", QuoteNone, start)
+		l.boost()
+		l.skipSpace()
+		l.boolean()
+		return
+	}
+
+	// Prefix ('+', '-' or 'NOT')
+	if c := l.input[l.pos]; c == '+' || c == '-' {
+		l.pos++
+		l.emit(TokenPrefix, l.input[start:l.pos], QuoteNone, start)
+		l.skipSpace()
+	} else if w := l.keyword(l.keywords.Not); w != "" {
+		l.pos += len(w)
+		l.emit(TokenNot, w, QuoteNone, start)
+		l.skipSpace()
+	}
+
+	l.fieldOperator()
+
+	if l.rangeTerm() || l.term() {
+		l.skipSpace()
+		l.boolean()
+		return
+	}
+
+	if l.pos < len(l.input) && l.input[l.pos] == '(' {
+		start = l.pos
+		l.pos++
+		l.emit(TokenOpenParen, "(", QuoteNone, start)
+		l.skipSpace()
+		return
+	}
+
+	l.boolean()
+}
+
+// fieldOperator recognizes "field":, 'field':, field: and a lone operator.
+// Quoted names may hold any character, with backslash escapes, but unless
+// they are made of field runes the operator must follow them directly.
+func (l *lexer) fieldOperator() {
+	s := l.input[l.pos:]
+	var (
+		name  string
+		quote Quote
+		n     int
+		plain = true
+	)
+	switch {
+	case s == "":
+		return
+	case l.isQuote(s[0]):
+		if name, n = unquote(s); n <= 2 {
+			return
+		}
+		quote = Quote(s[:1])
+		plain = 1+l.fieldLen(s[1:]) == n-1
+	default:
+		n = l.fieldLen(s)
+	}
+
+	if n == 0 {
+		op := matchOperator(s, noFieldOperatorList)
+		if op == "" {
+			return
+		}
+		start := l.pos
+		l.pos += len(op)
+		l.emit(TokenOperator, op, QuoteNone, start)
+		l.skipSpace()
+		return
+	}
+
+	if name == "" {
+		name = s[:n]
+		if m := fuzzyLen(s[n:]); m > 0 && endsTerm(s[n+m:]) {
+			// word~ is a fuzzy term rather than a field: a value for
+			// the operator must follow it directly, as in txt~'^foo'
+			return
+		}
+	}
+	i := n
+	for plain && i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	op := matchProximity(s[i:])
+	if op != "" && quote != QuoteNone && endsTerm(s[i+len(op):]) {
+		// "phrase"~5 rather than "field"~5 value
+		return
+	}
+	if op == "" {
+		op = matchOperator(s[i:], fieldOperatorList)
+	}
+	if op == "" {
+		return
+	}
+	start := l.pos
+	l.pos += n
+	l.emit(TokenField, name, quote, start)
+	l.pos = start + i + len(op)
+	l.emit(TokenOperator, op, QuoteNone, start+i)
+	l.skipSpace()
+}
+
+// term recognizes "quoted", 'quoted' and bare terms. Backslash escapes are
+// honored in all three.
+func (l *lexer) term() bool {
+	start := l.pos
+	s := l.input[l.pos:]
+	if s == "" {
+		return false
+	}
+	if l.isQuote(s[0]) {
+		if value, n := unquote(s); n > 0 {
+			l.pos += n
+			l.emit(TokenTerm, value, Quote(s[:1]), start)
+			if slop := matchProximity(s[n:]); slop != "" {
+				start = l.pos
+				l.pos += len(slop)
+				l.emit(TokenSlop, slop[1:], QuoteNone, start)
+			}
+			l.boost()
+			return true
+		}
+	}
+	n, escaped, caret, tilde := 0, false, -1, -1
+	for n < len(s) && !isSpace(s[n]) && s[n] != '(' && s[n] != ')' {
+		switch s[n] {
+		case '\\':
+			if n+1 < len(s) {
+				escaped = true
+				n++
+			}
+		case '^':
+			caret = n
+		case '~':
+			tilde = n
+		}
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	// A trailing ^N is a boost and a ~ or ~N before it a fuzzy suffix,
+	// unless they make the whole term
+	end := n
+	if caret > 0 && matchBoost(s[caret:n]) == s[caret:n] {
+		end = caret
+	}
+	fuzzy := 0
+	if tilde > 0 && tilde < end && fuzzyLen(s[tilde:end]) == end-tilde {
+		fuzzy = end - tilde
+		end = tilde
+	}
+	value := s[:end]
+	if escaped {
+		value = unescape(value)
+	}
+	l.pos += end
+	l.emit(TokenTerm, value, QuoteNone, start)
+	if fuzzy > 0 {
+		l.pos += fuzzy
+		l.emit(TokenFuzzy, s[end+1:end+fuzzy], QuoteNone, start+end)
+	}
+	l.boost()
+	return true
+}
+
+// boost recognizes a ^N suffix
+func (l *lexer) boost() {
+	if b := matchBoost(l.input[l.pos:]); b != "" {
+		start := l.pos
+		l.pos += len(b)
+		l.emit(TokenBoost, b[1:], QuoteNone, start)
+	}
+}
+
+// rangeTerm recognizes [lower TO upper] and its exclusive forms using {
+// and }. Tokens are emitted up to the first piece missing, leaving the
+// error to the parser.
+func (l *lexer) rangeTerm() bool {
+	if l.pos >= len(l.input) || l.input[l.pos] != '[' && l.input[l.pos] != '{' {
+		return false
+	}
+	start := l.pos
+	l.pos++
+	l.emit(TokenOpenRange, l.input[start:l.pos], QuoteNone, start)
+	l.skipSpace()
+	if !l.rangeBound() {
+		return true
+	}
+	l.skipSpace()
+	if s := l.input[l.pos:]; len(s) <= len(rangeTo) || !strings.HasPrefix(s, rangeTo) || !isSpace(s[len(rangeTo)]) {
+		return true
+	}
+	start = l.pos
+	l.pos += len(rangeTo)
+	l.emit(TokenTo, rangeTo, QuoteNone, start)
+	l.skipSpace()
+	if !l.rangeBound() {
+		return true
+	}
+	l.skipSpace()
+	if l.pos < len(l.input) && (l.input[l.pos] == ']' || l.input[l.pos] == '}') {
+		start = l.pos
+		l.pos++
+		l.emit(TokenCloseRange, l.input[start:l.pos], QuoteNone, start)
+		l.boost()
+	}
+	return true
+}
+
+// rangeBound recognizes a quoted or bare range bound. Bare bounds end at
+// whitespace, ] or }.
+func (l *lexer) rangeBound() bool {
+	start := l.pos
+	s := l.input[l.pos:]
+	if s == "" {
+		return false
+	}
+	if l.isQuote(s[0]) {
+		if value, n := unquote(s); n > 0 {
+			l.pos += n
+			l.emit(TokenTerm, value, Quote(s[:1]), start)
+			return true
+		}
+	}
+	n, escaped := 0, false
+	for n < len(s) && !isSpace(s[n]) && s[n] != ']' && s[n] != '}' {
+		if s[n] == '\\' && n+1 < len(s) {
+			escaped = true
+			n++
+		}
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	value := s[:n]
+	if escaped {
+		value = unescape(value)
+	}
+	l.pos += n
+	l.emit(TokenTerm, value, QuoteNone, start)
+	return true
+}
+
+// unquote returns the value of the quoted string s starts with and its
+// length including quotes, or 0 if the quote is not closed
+func unquote(s string) (value string, n int) {
+	q := s[0]
+	escaped := false
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				escaped = true
+				i++
+			}
+		case q:
+			value = s[1:i]
+			if escaped {
+				value = unescape(value)
+			}
+			return value, i + 1
+		}
+	}
+	return "", 0
+}
+
+// unescape removes the backslashes escaping characters of s. As in Lucene
+// a backslash makes any character literal, including itself.
+func unescape(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func (l *lexer) boolean() {
+	start := l.pos
+	if w := l.keyword(l.keywords.And); w != "" {
+		l.pos += len(w)
+		l.emit(TokenAnd, w, QuoteNone, start)
+	} else if w := l.keyword(l.keywords.Or); w != "" {
+		l.pos += len(w)
+		l.emit(TokenOr, w, QuoteNone, start)
+	} else {
+		return
+	}
+	l.skipSpace()
+}
+
+// keyword returns the first of words found at the current position and
+// followed by a word boundary
+func (l *lexer) keyword(words []string) string {
+	s := l.input[l.pos:]
+	for _, w := range words {
+		if w == "" || !strings.HasPrefix(s, w) {
+			continue
+		}
+		next := len(s) > len(w) && isWord(s[len(w)])
+		if isWord(w[len(w)-1]) != next {
+			return w
+		}
+	}
+	return ""
+}
+
+// matchProximity returns the leading '~' followed by digits of s, if any
+func matchProximity(s string) string {
+	if s == "" || s[0] != '~' {
+		return ""
+	}
+	n := 1
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	if n == 1 {
+		return ""
+	}
+	return s[:n]
+}
+
+// fuzzyLen returns the length of the leading '~' and digits of s
+func fuzzyLen(s string) int {
+	if s == "" || s[0] != '~' {
+		return 0
+	}
+	n := 1
+	for n < len(s) && s[n] >= '0' && s[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// endsTerm reports whether s starts where a term may end: at whitespace,
+// a closing parenthesis, a boost or the end of input
+func endsTerm(s string) bool {
+	return s == "" || isSpace(s[0]) || s[0] == ')' || matchBoost(s) != ""
+}
+
+// matchBoost returns the leading '^' followed by a decimal number of s, if
+// any
+func matchBoost(s string) string {
+	if s == "" || s[0] != '^' {
+		return ""
+	}
+	digits := func(i int) int {
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		return i
+	}
+	n := digits(1)
+	if n == 1 {
+		return ""
+	}
+	if n+1 < len(s) && s[n] == '.' {
+		if m := digits(n + 1); m > n+1 {
+			n = m
+		}
+	}
+	return s[:n]
+}
+
+// matchOperator returns the first operator of ops s starts with
+func matchOperator(s string, ops []string) string {
+	for _, op := range ops {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return ""
+}
+
+func isWord(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
@@ -0,0 +1,373 @@
+package searchquery
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// TextMode selects how terms matched with : or !: compare to text
+type TextMode int
+
+const (
+	TextTokens    TextMode = iota // the words of the term appear in order among the words of the value
+	TextSubstring                 // the term appears anywhere in the value
+	TextWhole                     // the term is the whole value
+)
+
+// Matcher evaluates queries against documents in memory. A Matcher is safe
+// for concurrent use.
+type Matcher struct {
+	foldCase bool
+	textMode TextMode
+}
+
+// MatchOption configures a Matcher
+type MatchOption func(*Matcher)
+
+// WithCaseFolding sets whether text compares case-insensitively, true by
+// default. Regexes are used as written.
+func WithCaseFolding(enabled bool) MatchOption {
+	return func(m *Matcher) {
+		m.foldCase = enabled
+	}
+}
+
+// WithTextMode sets how terms compare to text, TextTokens by default
+func WithTextMode(mode TextMode) MatchOption {
+	return func(m *Matcher) {
+		m.textMode = mode
+	}
+}
+
+var defaultMatcher = NewMatcher()
+
+// NewMatcher returns a Matcher with the default settings, modified by opts
+func NewMatcher(opts ...MatchOption) *Matcher {
+	m := &Matcher{foldCase: true}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Match reports whether doc satisfies q using the default Matcher
+func (q Query) Match(doc interface{}) bool {
+	return defaultMatcher.Match(q, doc)
+}
+
+// Match reports whether doc satisfies q: it must match every required
+// clause and no excluded one, and at least one optional clause if none is
+// required.
+//
+// doc is a map with string keys or a struct, or a pointer to either. Fields
+// are keys of a map, or dotted paths into nested maps and structs such as
+// author.name. Struct fields are named by a searchquery tag or else their
+// Go name, compared case-insensitively when no name matches exactly; a tag
+// of "-" hides a field. Fields of embedded structs are promoted as in
+// encoding/json. The fields of each struct type are looked up once.
+//
+// A term without a field matches any value of doc. A field holding a slice
+// matches if any of its elements does, so a negated operator such as !:
+// matches if none does, including when the field is missing. Relational
+// operators compare numbers, times, bools and IPs as such when both sides
+// parse, and text otherwise. Document text that parses as a number, time or
+// IP, such as "42" or "01.06.2001", compares as one. A regex that does not
+// compile matches nothing.
+//
+// Match compiles q each time it is called; Compile a query matched often.
+func (m *Matcher) Match(q Query, doc interface{}) bool {
+	p := &Program{m: m}
+	p.root, _ = p.group(&q)
+	return p.Match(doc)
+}
+
+// document gives a Matcher the values of a field, or of every field for ""
+type document interface {
+	values(field string) []interface{}
+}
+
+type mapDoc map[string]interface{}
+
+func (d mapDoc) values(field string) []interface{} {
+	if field == "" {
+		return flatten(reflect.ValueOf(map[string]interface{}(d)), nil, nil)
+	}
+	if v, ok := d[field]; ok {
+		return flatten(reflect.ValueOf(v), nil, nil)
+	}
+	return lookup(reflect.ValueOf(map[string]interface{}(d)), field, nil, nil)
+}
+
+// valueDoc is any other document, read through reflection
+type valueDoc struct {
+	v reflect.Value
+}
+
+func (d valueDoc) values(field string) []interface{} {
+	return lookup(d.v, field, nil, nil)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// indirect returns the value v points to, or an invalid Value if nil
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// visit identifies a map, slice or addressable struct or array being
+// walked, and the path lookup is looking for in it
+type visit struct {
+	typ  reflect.Type
+	ptr  uintptr
+	len  int
+	path string
+}
+
+// enter adds v to in, the values walked into so far, and reports false if
+// it is there already: the document refers back to it.
+func enter(in *map[visit]bool, v reflect.Value, path string) (visit, bool) {
+	var k visit
+	switch v.Kind() {
+	case reflect.Map:
+		k = visit{v.Type(), v.Pointer(), 0, path}
+	case reflect.Slice:
+		k = visit{v.Type(), v.Pointer(), v.Len(), path}
+	case reflect.Struct, reflect.Array:
+		if !v.CanAddr() {
+			return k, true
+		}
+		k = visit{v.Type(), v.UnsafeAddr(), 0, path}
+	default:
+		return k, true
+	}
+	if (*in)[k] {
+		return k, false
+	}
+	if *in == nil {
+		*in = make(map[visit]bool)
+	}
+	(*in)[k] = true
+	return k, true
+}
+
+// lookup appends the values of the dotted path in v to values. A name at
+// each step may itself contain dots. in holds the values being walked: the
+// path only stays as it is in a slice or array, so only those can cycle.
+func lookup(v reflect.Value, path string, values []interface{}, in map[visit]bool) []interface{} {
+	if path == "" {
+		return flatten(v, values, in)
+	}
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return values
+		}
+		k, ok := enter(&in, v, path)
+		if !ok {
+			return values
+		}
+		defer delete(in, k)
+		for i := 0; i < v.Len(); i++ {
+			values = lookup(v.Index(i), path, values, in)
+		}
+		return values
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return values
+		}
+		if e := v.MapIndex(reflect.ValueOf(path).Convert(v.Type().Key())); e.IsValid() {
+			return flatten(e, values, in)
+		}
+		if i := strings.IndexByte(path, '.'); i > 0 {
+			if e := v.MapIndex(reflect.ValueOf(path[:i]).Convert(v.Type().Key())); e.IsValid() {
+				return lookup(e, path[i+1:], values, in)
+			}
+		}
+	case reflect.Struct:
+		plan := planOf(v.Type())
+		if f := plan.field(path); f != nil {
+			return flatten(f.value(v), values, in)
+		}
+		if i := strings.IndexByte(path, '.'); i > 0 {
+			if f := plan.field(path[:i]); f != nil {
+				return lookup(f.value(v), path[i+1:], values, in)
+			}
+		}
+	}
+	return values
+}
+
+// flatten appends the scalar values of v to values, descending into
+// pointers, slices, maps and structs, but not into those in, the values
+// being walked
+func flatten(v reflect.Value, values []interface{}, in map[visit]bool) []interface{} {
+	v = indirect(v)
+	k, ok := enter(&in, v, "")
+	if !ok {
+		return values
+	}
+	defer delete(in, k)
+	switch v.Kind() {
+	case reflect.Invalid:
+		return values
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// []byte and net.IP are values
+			break
+		}
+		for i := 0; i < v.Len(); i++ {
+			values = flatten(v.Index(i), values, in)
+		}
+		return values
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			values = flatten(v.MapIndex(k), values, in)
+		}
+		return values
+	case reflect.Struct:
+		if v.Type() == timeType {
+			break
+		}
+		for _, f := range planOf(v.Type()).fields {
+			values = flatten(f.value(v), values, in)
+		}
+		return values
+	}
+	if !v.CanInterface() {
+		return values
+	}
+	return append(values, v.Interface())
+}
+
+// matchProximity reports whether the words of sq.Value appear in s within
+// sq.Slop moves of each other, counted as in Lucene
+func (m *Matcher) matchProximity(sq SubQuery, s string) bool {
+	value := sq.Value
+	if m.foldCase {
+		s, value = strings.ToLower(s), strings.ToLower(value)
+	}
+	terms, words := tokens(value), tokens(s)
+	if len(terms) == 0 {
+		return false
+	}
+	positions := make([][]int, len(terms))
+	for i, t := range terms {
+		for j, w := range words {
+			if w == t {
+				positions[i] = append(positions[i], j)
+			}
+		}
+		if positions[i] == nil {
+			return false
+		}
+	}
+	used := make(map[int]bool, len(terms))
+	var search func(i, min, max int) bool
+	search = func(i, min, max int) bool {
+		if i == len(terms) {
+			return max-min <= sq.Slop
+		}
+		for _, p := range positions[i] {
+			if used[p] {
+				continue
+			}
+			offset := p - i
+			lo, hi := min, max
+			if i == 0 || offset < lo {
+				lo = offset
+			}
+			if i == 0 || offset > hi {
+				hi = offset
+			}
+			if hi-lo > sq.Slop {
+				continue
+			}
+			used[p] = true
+			found := search(i+1, lo, hi)
+			used[p] = false
+			if found {
+				return true
+			}
+		}
+		return false
+	}
+	return search(0, 0, 0)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, ok := v.(time.Duration); !ok {
+			return float64(rv.Int()), true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+func parseTime(s string) (time.Time, bool) {
+	for _, layouts := range [][]string{DefaultTimeLayouts, DefaultDateLayouts} {
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// text returns the document value v as text
+func text(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	if f, ok := toFloat(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.String {
+		return rv.String()
+	}
+	return fmt.Sprint(v)
+}
+
+// tokens splits s into words of letters and digits
+func tokens(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func minInt(a int, rest ...int) int {
+	for _, b := range rest {
+		if b < a {
+			a = b
+		}
+	}
+	return a
+}
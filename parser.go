@@ -0,0 +1,287 @@
+package searchquery
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// Parser holds the syntax settings used to parse queries. The zero value is
+// not usable; create one with NewParser.
+type Parser struct {
+	defaultFields   []string
+	defaultOperator Operator
+	keywords        Keywords
+	singleQuotes    bool
+	isFieldRune     func(rune) bool
+	precedence      bool
+	fields          map[string]bool   // allowed field names, nil for any
+	aliases         map[string]string // field names rewritten by the parser
+	schema          Schema
+
+	// Limits on untrusted input, 0 for none
+	maxLength      int
+	maxDepth       int
+	maxClauses     int
+	maxRegexLength int
+
+	regexSyntax        RegexSyntax
+	maxRegexComplexity int
+}
+
+// Option configures a Parser
+type Option func(*Parser)
+
+// Keywords lists the words recognized as boolean operators. Words made of
+// symbols, such as "&", must be directly followed by a word character.
+type Keywords struct {
+	And []string
+	Or  []string
+	Not []string
+}
+
+var (
+	KeywordsEnglish = Keywords{And: []string{"AND"}, Or: []string{"OR"}, Not: []string{"NOT"}}
+	KeywordsFrench  = Keywords{And: []string{"ET"}, Or: []string{"OU"}, Not: []string{"PAS"}}
+	KeywordsGerman  = Keywords{And: []string{"UND"}, Or: []string{"ODER"}, Not: []string{"NICHT"}}
+	KeywordsItalian = Keywords{And: []string{"E"}, Or: []string{"O"}, Not: []string{"NON"}}
+	KeywordsSymbols = Keywords{And: []string{"&"}, Or: []string{"|"}}
+
+	// KeywordsAll is the default: symbols and every language above
+	KeywordsAll = MergeKeywords(KeywordsSymbols, KeywordsEnglish, KeywordsFrench, KeywordsGerman, KeywordsItalian)
+)
+
+// MergeKeywords combines keyword sets. Earlier words take precedence when
+// several match at the same position.
+func MergeKeywords(sets ...Keywords) (k Keywords) {
+	for _, set := range sets {
+		k.And = append(k.And, set.And...)
+		k.Or = append(k.Or, set.Or...)
+		k.Not = append(k.Not, set.Not...)
+	}
+	return
+}
+
+var defaultParser = NewParser()
+
+// NewParser returns a Parser accepting the default syntax, modified by opts
+func NewParser(opts ...Option) *Parser {
+	p := &Parser{
+		defaultOperator: OperatorField,
+		keywords:        KeywordsAll,
+		singleQuotes:    true,
+		isFieldRune:     FieldRunesWord,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// WithDefaultField sets the field given to terms without one, including
+// terms inside parenthesized groups without a field. With several fields
+// each such term is expanded into an OR group with one clause per field.
+func WithDefaultField(fields ...string) Option {
+	return func(p *Parser) {
+		p.defaultFields = fields
+	}
+}
+
+// WithDefaultOperator sets the operator given to terms without one,
+// OperatorField by default
+func WithDefaultOperator(op Operator) Option {
+	return func(p *Parser) {
+		p.defaultOperator = op
+	}
+}
+
+// WithKeywords sets the boolean keywords, KeywordsAll by default
+func WithKeywords(k Keywords) Option {
+	return func(p *Parser) {
+		p.keywords = k
+	}
+}
+
+// WithSingleQuotes sets whether 'single quotes' delimit phrases and field
+// names like "double quotes" do. When disabled a single quote is an
+// ordinary term character.
+func WithSingleQuotes(enabled bool) Option {
+	return func(p *Parser) {
+		p.singleQuotes = enabled
+	}
+}
+
+// Field rune sets for WithFieldRunes
+var (
+	// FieldRunesWord allows ASCII letters, digits and '_'
+	FieldRunesWord = isWordRune
+
+	// FieldRunesUnicode allows the letters, digits and marks of any script
+	// and '_', as in métadonnées:x
+	FieldRunesUnicode = isUnicodeWordRune
+
+	// FieldRunesPath adds '.' and '-' to FieldRunesUnicode for nested
+	// document paths, as in author.name:smith or meta-data:x
+	FieldRunesPath = func(r rune) bool { return r == '.' || r == '-' || isUnicodeWordRune(r) }
+)
+
+// WithFieldRunes sets the characters allowed in unquoted field names,
+// FieldRunesWord by default. Quoted field names such as "my field":x may
+// hold any character.
+func WithFieldRunes(f func(rune) bool) Option {
+	return func(p *Parser) {
+		p.isFieldRune = f
+	}
+}
+
+// WithPrecedence sets whether AND and OR may be mixed without parentheses.
+// When enabled NOT binds tighter than AND and AND tighter than OR, so
+// "a AND b OR c" parses as "(a AND b) OR c". Otherwise mixing them is an
+// ErrorMixedBoolean.
+func WithPrecedence(enabled bool) Option {
+	return func(p *Parser) {
+		p.precedence = enabled
+	}
+}
+
+// WithFields restricts the fields a query may name to names, after
+// aliases are rewritten. Any other field is an ErrorUnknownField.
+func WithFields(names ...string) Option {
+	return func(p *Parser) {
+		p.fields = make(map[string]bool, len(names))
+		for _, name := range names {
+			p.fields[name] = true
+		}
+	}
+}
+
+// WithFieldAliases rewrites the field names that are keys of aliases to
+// their value, as in from: to sender_email:
+func WithFieldAliases(aliases map[string]string) Option {
+	return func(p *Parser) {
+		p.aliases = aliases
+	}
+}
+
+// WithMaxLength limits queries to n bytes. Longer ones are an
+// ErrorTooLong.
+func WithMaxLength(n int) Option {
+	return func(p *Parser) {
+		p.maxLength = n
+	}
+}
+
+// WithMaxDepth limits the nesting of parenthesized groups to n levels.
+// Deeper ones are an ErrorTooDeep.
+func WithMaxDepth(n int) Option {
+	return func(p *Parser) {
+		p.maxDepth = n
+	}
+}
+
+// WithMaxClauses limits queries to n terms and groups in all. More are an
+// ErrorTooManyClauses.
+func WithMaxClauses(n int) Option {
+	return func(p *Parser) {
+		p.maxClauses = n
+	}
+}
+
+// WithMaxRegexLength limits the values of regex operators to n bytes.
+// Longer ones are an ErrorRegexTooLong.
+func WithMaxRegexLength(n int) Option {
+	return func(p *Parser) {
+		p.maxRegexLength = n
+	}
+}
+
+// Parse parses s, treating clauses without a prefix as optional
+func (p *Parser) Parse(s string) (*Query, error) {
+	return p.parseQuery(s, PrefixOptional)
+}
+
+// ParseGreedy parses s, treating clauses without a prefix as required
+func (p *Parser) ParseGreedy(s string) (*Query, error) {
+	return p.parseQuery(s, PrefixRequired)
+}
+
+func (p *Parser) parseQuery(input string, defaultPrefix string) (q *Query, err error) {
+	if p.maxLength > 0 && len(input) > p.maxLength {
+		// At the start of the rune the limit falls in
+		offset := p.maxLength
+		for offset > 0 && !utf8.RuneStart(input[offset]) {
+			offset--
+		}
+		return nil, newParseError(input, offset, ErrorTooLong, []string{ExpectEnd}, "Query longer than %d bytes", p.maxLength)
+	}
+	ps := &parseState{
+		Parser:        p,
+		input:         input,
+		lexer:         p.newLexer(input),
+		defaultPrefix: defaultPrefix,
+	}
+	if q, err = ps.parse(SubQuery{Operator: p.defaultOperator}); err != nil {
+		return
+	}
+	if t := ps.peek(); t != nil {
+		err = newParseError(input, t.Start, ErrorUnbalancedParen, []string{ExpectEnd}, "Unexpected )")
+		return
+	}
+	return
+}
+
+func (p *Parser) isQuote(c byte) bool {
+	return c == '"' || c == '\'' && p.singleQuotes
+}
+
+// fieldLen returns the length in bytes of the field name s starts with
+func (p *Parser) fieldLen(s string) (n int) {
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !p.isFieldRune(r) {
+			break
+		}
+		n += size
+	}
+	return
+}
+
+// field returns the field name t refers to, rewriting aliases
+func (p *parseState) field(t *Token) (string, error) {
+	name := t.Value
+	if alias, ok := p.aliases[name]; ok {
+		name = alias
+	}
+	_, inSchema := p.schema[name]
+	if p.fields != nil && !p.fields[name] || p.schema != nil && !inSchema {
+		return "", newParseError(p.input, t.Start, ErrorUnknownField, []string{ExpectField}, "Unknown field: %s", t.Value)
+	}
+	return name, nil
+}
+
+func isWordRune(r rune) bool {
+	return r < utf8.RuneSelf && isWord(byte(r))
+}
+
+func isUnicodeWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// withDefaultField gives the default field to an unfielded term
+func (p *Parser) withDefaultField(sq SubQuery) SubQuery {
+	if sq.Field != "" || len(p.defaultFields) == 0 {
+		return sq
+	}
+	if len(p.defaultFields) == 1 {
+		sq.Field = p.defaultFields[0]
+		return sq
+	}
+	group := SubQuery{
+		Operator: OperatorSubquery,
+		Query:    &Query{Optional: make([]SubQuery, len(p.defaultFields))},
+	}
+	for i, field := range p.defaultFields {
+		sq.Field = field
+		group.Query.Optional[i] = sq
+	}
+	return group
+}
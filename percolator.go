@@ -0,0 +1,275 @@
+package searchquery
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Percolator finds which of many stored queries match a document. Each
+// query is indexed by something a document must have for it to match: a
+// word of a required term, one of the values a required field must equal,
+// or else any value for a required field. A document is
+// only matched against the queries found under its own fields and words,
+// and against queries that could not be indexed, such as those made only
+// of negations.
+//
+// A Percolator is safe for concurrent use.
+type Percolator struct {
+	m    *Matcher
+	opts []MatchOption
+
+	mu        sync.RWMutex
+	queries   map[string]*percolated
+	postings  map[percolatorKey]map[string]*percolated
+	fields    map[string]int // keys per field
+	unindexed map[string]*percolated
+}
+
+// percolatorKey is a word that must appear in a field, or any value of the
+// field when term is empty. An empty field stands for any field.
+type percolatorKey struct {
+	field, term string
+}
+
+type percolated struct {
+	id   string
+	prog *Program
+	keys []percolatorKey
+}
+
+// NewPercolator returns an empty Percolator matching as a Matcher with
+// opts would
+func NewPercolator(opts ...MatchOption) *Percolator {
+	return &Percolator{
+		m:         NewMatcher(opts...),
+		opts:      opts,
+		queries:   make(map[string]*percolated),
+		postings:  make(map[percolatorKey]map[string]*percolated),
+		fields:    make(map[string]int),
+		unindexed: make(map[string]*percolated),
+	}
+}
+
+// Add stores q under id, replacing any query already stored under it. It
+// returns an error if q does not compile.
+func (p *Percolator) Add(id string, q *Query) error {
+	prog, err := Compile(q, p.opts...)
+	if err != nil {
+		return err
+	}
+	pq := &percolated{id: id, prog: prog}
+	if q != nil {
+		pq.keys = p.queryKeys(q)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remove(id)
+	p.queries[id] = pq
+	if pq.keys == nil {
+		p.unindexed[id] = pq
+		return nil
+	}
+	for _, k := range pq.keys {
+		ids := p.postings[k]
+		if ids == nil {
+			ids = make(map[string]*percolated)
+			p.postings[k] = ids
+		}
+		ids[id] = pq
+		p.fields[k.field]++
+	}
+	return nil
+}
+
+// Remove deletes the query stored under id, reporting whether there was one
+func (p *Percolator) Remove(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.remove(id)
+}
+
+func (p *Percolator) remove(id string) bool {
+	pq, ok := p.queries[id]
+	if !ok {
+		return false
+	}
+	delete(p.queries, id)
+	delete(p.unindexed, id)
+	for _, k := range pq.keys {
+		if ids := p.postings[k]; ids != nil {
+			if delete(ids, id); len(ids) == 0 {
+				delete(p.postings, k)
+			}
+		}
+		if p.fields[k.field]--; p.fields[k.field] == 0 {
+			delete(p.fields, k.field)
+		}
+	}
+	return true
+}
+
+// Len returns the number of stored queries
+func (p *Percolator) Len() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.queries)
+}
+
+// Match returns the sorted IDs of the stored queries that doc satisfies.
+// doc is read as by Matcher.Match.
+func (p *Percolator) Match(doc interface{}) []string {
+	var d document
+	if m, ok := doc.(map[string]interface{}); ok {
+		d = mapDoc(m)
+	} else {
+		d = valueDoc{reflect.ValueOf(doc)}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	candidates := make(map[string]*percolated)
+	for field := range p.fields {
+		values := d.values(field)
+		if len(values) == 0 {
+			continue
+		}
+		for id, pq := range p.postings[percolatorKey{field: field}] {
+			candidates[id] = pq
+		}
+		for _, v := range values {
+			for _, t := range tokens(p.fold(text(v))) {
+				for id, pq := range p.postings[percolatorKey{field, t}] {
+					candidates[id] = pq
+				}
+			}
+		}
+	}
+	for id, pq := range p.unindexed {
+		candidates[id] = pq
+	}
+
+	var ids []string
+	for id, pq := range candidates {
+		if pq.prog.Match(doc) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (p *Percolator) fold(s string) string {
+	if p.m.foldCase {
+		return strings.ToLower(s)
+	}
+	return s
+}
+
+// queryKeys returns keys of which a document must have at least one to
+// match q, or nil if there are none
+func (p *Percolator) queryKeys(q *Query) []percolatorKey {
+	if len(q.Required) > 0 {
+		// The narrowest set of any required clause will do
+		var best []percolatorKey
+		for _, sq := range q.Required {
+			if keys := p.subQueryKeys(sq); keys != nil && (best == nil || narrower(keys, best)) {
+				best = keys
+			}
+		}
+		return best
+	}
+	// Every optional clause must contribute
+	var keys []percolatorKey
+	for _, sq := range q.Optional {
+		k := p.subQueryKeys(sq)
+		if k == nil {
+			return nil
+		}
+		keys = append(keys, k...)
+	}
+	return keys
+}
+
+func (p *Percolator) subQueryKeys(sq SubQuery) []percolatorKey {
+	switch sq.Operator {
+	case OperatorSubquery:
+		if sq.Query == nil {
+			return nil
+		}
+		return p.queryKeys(sq.Query)
+	case OperatorFieldNeg, OperatorRegexNeg, OperatorRelNE:
+		return nil
+	case OperatorProximity:
+		return p.termKey(sq)
+	case OperatorExact, OperatorRelE, OperatorCSV:
+		if keys := p.valueKeys(sq); keys != nil {
+			return keys
+		}
+	case OperatorField:
+		if sq.Pattern == PatternNone && sq.Fuzzy == 0 && p.m.textMode != TextSubstring {
+			if keys := p.termKey(sq); keys != nil {
+				return keys
+			}
+		}
+	}
+	if sq.Field == "" {
+		return nil
+	}
+	return []percolatorKey{{field: sq.Field}}
+}
+
+// termKey returns the longest word of the value of sq, every one of which
+// a matching value holds
+func (p *Percolator) termKey(sq SubQuery) []percolatorKey {
+	var longest string
+	for _, t := range tokens(p.fold(sq.Value)) {
+		if len(t) > len(longest) {
+			longest = t
+		}
+	}
+	if longest == "" {
+		return nil
+	}
+	return []percolatorKey{{sq.Field, longest}}
+}
+
+// valueKeys returns a key for each value of sq, provided that every one is
+// a single word a document value can only equal as text
+func (p *Percolator) valueKeys(sq SubQuery) []percolatorKey {
+	values := []string{sq.Value}
+	if sq.Operator == OperatorCSV {
+		values = strings.Split(sq.Value, ",")
+	}
+	keys := make([]percolatorKey, len(values))
+	for i, v := range values {
+		v = p.fold(strings.TrimSpace(v))
+		if t := tokens(v); len(t) != 1 || t[0] != v {
+			return nil
+		}
+		if o := newOperand(v, nil, false); o.isNum || o.isTime || o.isBool || o.ip != nil {
+			return nil
+		}
+		keys[i] = percolatorKey{sq.Field, v}
+	}
+	return keys
+}
+
+// narrower reports whether a is expected to select fewer queries than b:
+// words over fields, then fewer keys
+func narrower(a, b []percolatorKey) bool {
+	words := func(keys []percolatorKey) bool {
+		for _, k := range keys {
+			if k.term == "" {
+				return false
+			}
+		}
+		return true
+	}
+	if wa, wb := words(a), words(b); wa != wb {
+		return wa
+	}
+	return len(a) < len(b)
+}
@@ -0,0 +1,84 @@
+package searchquery
+
+// clause is a parsed SubQuery waiting for its place in the Query, used when
+// boolean operators are combined by precedence
+type clause struct {
+	prefix   string
+	subQuery SubQuery
+	start    int
+	postBool string // operator joining the clause to the next one
+}
+
+// combine inserts clauses into q giving NOT precedence over AND and AND
+// over OR. Runs of clauses joined by AND inside an OR become groups of
+// their own; clauses without an operator between them are independent,
+// as with the prefix syntax.
+func (p *parseState) combine(q *Query, clauses []clause, parentField string) error {
+	for len(clauses) > 0 {
+		// A unit is a run of clauses joined by AND or OR
+		n := 1
+		for n < len(clauses) && clauses[n-1].postBool != "" {
+			n++
+		}
+		unit := clauses[:n]
+		clauses = clauses[n:]
+
+		hasAnd, hasOr := false, false
+		for _, c := range unit[:n-1] {
+			hasAnd = hasAnd || c.postBool == "AND"
+			hasOr = hasOr || c.postBool == "OR"
+		}
+		Bool := ""
+		switch {
+		case hasAnd && hasOr:
+			if err := p.combineOr(q, unit, parentField); err != nil {
+				return err
+			}
+			continue
+		case hasAnd:
+			Bool = "AND"
+		case hasOr:
+			Bool = "OR"
+		}
+		for _, c := range unit {
+			if err := p.insert(q, c.prefix, Bool, c.subQuery, c.start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// combineOr inserts the operands of an OR into q as optional clauses,
+// grouping the runs joined by AND
+func (p *parseState) combineOr(q *Query, unit []clause, parentField string) error {
+	for len(unit) > 0 {
+		n := 1
+		for n < len(unit) && unit[n-1].postBool == "AND" {
+			n++
+		}
+		and := unit[:n]
+		unit = unit[n:]
+		if n == 1 {
+			if err := p.insert(q, and[0].prefix, "OR", and[0].subQuery, and[0].start); err != nil {
+				return err
+			}
+			continue
+		}
+		group := SubQuery{
+			Field:    parentField,
+			Operator: OperatorSubquery,
+			Query:    new(Query),
+		}
+		for _, c := range and {
+			if err := p.insert(group.Query, c.prefix, "AND", c.subQuery, c.start); err != nil {
+				return err
+			}
+		}
+		if len(group.Query.Required) == 0 {
+			return newParseError(p.input, and[0].start, ErrorNoPositiveTerm, []string{ExpectTerm, ExpectOpenParen}, "No positive value in AND group")
+		}
+		q.Optional = append(q.Optional, group)
+	}
+	return nil
+}
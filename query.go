@@ -3,8 +3,9 @@
 package searchquery
 
 import (
-	"fmt"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -19,7 +20,15 @@ type SubQuery struct {
 	Operator Operator
 	Field    string
 	Value    string
-	Query    *Query // non-nil when Op == ()
+	Pattern  Pattern // wildcards in a bare Value when Op is : or !:
+	Fuzzy    int     // max edit distance of a bare Value when Op is : or !:
+	Slop     int     // word distance when Op == ~N
+	Boost    float64 // weight of matches, 0 for the default of 1
+	Range    *Range  // non-nil when Op == []
+	Query    *Query  // non-nil when Op == ()
+
+	Typed  *Typed         // non-nil once Schema.Validate converts Value
+	Regexp *regexp.Regexp // Value compiled when the Parser checks regexes
 }
 
 type Quote string
@@ -30,185 +39,274 @@ const (
 	QuoteSingle       = `'`
 	QuoteDouble       = `"`
 
-	OperatorCSV      Operator = `#`
-	OperatorField             = `:`
-	OperatorNone              = ``
-	OperatorRegex             = `~`
-	OperatorRegexNeg          = `!~`
-	OperatorRelE              = `==`
-	OperatorRelGT             = `>`
-	OperatorRelGTE            = `>=`
-	OperatorRelLT             = `<`
-	OperatorRelLTE            = `<=`
-	OperatorRelNE             = `!=`
-	OperatorSubquery          = `()`
+	OperatorCSV        Operator = `#`
+	OperatorExact               = `=`
+	OperatorField               = `:`
+	OperatorFieldNeg            = `!:`
+	OperatorNone                = ``
+	OperatorProximity           = `~N`
+	OperatorRange               = `[]`
+	OperatorRegex               = `~`
+	OperatorRegexMatch          = `=~`
+	OperatorRegexNeg            = `!~`
+	OperatorRelE                = `==`
+	OperatorRelGT               = `>`
+	OperatorRelGTE              = `>=`
+	OperatorRelLT               = `<`
+	OperatorRelLTE              = `<=`
+	OperatorRelNE               = `!=`
+	OperatorSubquery            = `()`
 
 	PrefixExcluded string = `-`
 	PrefixOptional        = ``
 	PrefixRequired        = `+`
 )
 
-var R = struct {
-	Prefix, PrefixWord                   *regexp.Regexp
-	FieldOpQQ, FieldOpQ, FieldOp, OpOnly *regexp.Regexp
-	TermQQ, TermQ, SingleTerm            *regexp.Regexp
-	OpenParen, CloseParen                *regexp.Regexp
-	BoolAnd, BoolOr                      *regexp.Regexp
-}{
-	Prefix:     regexp.MustCompile(`^(\+|-)\s*`),
-	PrefixWord: regexp.MustCompile(`^(` + reNot + `)\b\s*`),
-	FieldOpQQ:  regexp.MustCompile(`^"(` + reField + `)"\s*(` + reOperator + `)\s*`),
-	FieldOpQ:   regexp.MustCompile(`^'(` + reField + `)'\s*(` + reOperator + `)\s*`),
-	FieldOp:    regexp.MustCompile(`^(` + reField + `)\s*(` + reOperator + `)\s*`),
-	OpOnly:     regexp.MustCompile(`^()(` + reOperatorNoField + `)\s*`),
-	TermQQ:     regexp.MustCompile(`^(")([^"]*?)"\s*`),
-	TermQ:      regexp.MustCompile(`^(')([^']*?)'\s*`),
-	SingleTerm: regexp.MustCompile(`^()(` + reTerm + `)\s*`),
-	OpenParen:  regexp.MustCompile(`^\(\s*`),
-	CloseParen: regexp.MustCompile(`^\)\s*`),
-	BoolAnd:    regexp.MustCompile(`^(` + reAnd + `)\b\s*`),
-	BoolOr:     regexp.MustCompile(`^(` + reOr + `)\b\s*`),
-}
-
-var (
-	reTerm            = `[^\s()]+`
-	reAnd             = `\&|AND|ET|UND|E`
-	reOr              = `\||OR|OU|ODER|O`
-	reNot             = `NOT|PAS|NICHT|NON`
-	reField           = `[\w]+`
-	reOperator        = `~\d+|==|<=|>=|!=|!:|=~|!~|[:=<>~#]`
-	reOperatorNoField = `=~|!~|[~:#]`
-)
-
-var (
-	fieldOperators = []*regexp.Regexp{
-		R.FieldOpQQ,
-		R.FieldOpQ,
-		R.FieldOp,
-		R.OpOnly,
-	}
-	terms = []*regexp.Regexp{
-		R.TermQQ,
-		R.TermQ,
-		R.SingleTerm,
-	}
-)
-
+// Parse parses s with the default syntax, treating clauses without a prefix
+// as optional
 func Parse(s string) (q *Query, err error) {
-	q, _, err = parse(s, PrefixOptional, "", OperatorField)
-	return
+	return defaultParser.Parse(s)
 }
 
+// ParseGreedy parses s with the default syntax, treating clauses without a
+// prefix as required
 func ParseGreedy(s string) (q *Query, err error) {
-	q, _, err = parse(s, PrefixRequired, "", OperatorField)
-	return
+	return defaultParser.ParseGreedy(s)
 }
 
-func (q Query) String() string {
-	buf := make([]string, 0, len(q.Required)+len(q.Optional)+len(q.Excluded))
-	for _, sq := range q.Required {
-		buf = append(buf, PrefixRequired+sq.String())
+// MarshalText implements encoding.TextMarshaler using String
+func (q Query) MarshalText() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler using Parse
+func (q *Query) UnmarshalText(text []byte) error {
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
 	}
-	for _, sq := range q.Optional {
-		buf = append(buf, PrefixOptional+sq.String())
+	*q = *parsed
+	return nil
+}
+
+// Weight returns the weight of matches of sq: its Boost, or 1 when unset
+func (sq SubQuery) Weight() float64 {
+	if sq.Boost == 0 {
+		return 1
 	}
-	for _, sq := range q.Excluded {
-		buf = append(buf, PrefixExcluded+sq.String())
+	return sq.Boost
+}
+
+// parseState holds the progress of a single Parse call
+type parseState struct {
+	*Parser
+	input         string
+	lexer         lexer
+	pos           int
+	defaultPrefix string
+	depth         int // of the group being parsed
+	clauses       int // parsed so far
+}
+
+// peek returns the current token, or nil at the end of input
+func (p *parseState) peek() *Token {
+	for p.pos >= len(p.lexer.tokens) {
+		if !p.lexer.more() {
+			return nil
+		}
+		p.pos = 0
 	}
-	return strings.Join(buf, " ")
+	return &p.lexer.tokens[p.pos]
 }
 
-func (sq SubQuery) String() string {
-	if sq.Operator == OperatorSubquery {
-		return "(" + sq.Query.String() + ")"
+func (p *parseState) peekKind(kind TokenKind) *Token {
+	if t := p.peek(); t != nil && t.Kind == kind {
+		return t
 	}
-	return fmt.Sprintf("%s%s%s%s%s", sq.Field, sq.Operator, sq.Quote, sq.Value, sq.Quote)
+	return nil
 }
 
-func parse(s string, defaultPrefix string, parentField string, parentOperator Operator) (q *Query, remaining string, err error) {
+// offset returns the position of the current token in the input
+func (p *parseState) offset() int {
+	if t := p.peek(); t != nil {
+		return t.Start
+	}
+	return len(p.input)
+}
+
+// parse parses clauses up to a closing parenthesis or the end of input.
+// Terms inherit the field and operator of parent.
+func (p *parseState) parse(parent SubQuery) (q *Query, err error) {
 	q = new(Query)
+	start := p.offset()
 	preBool := ""
-	for s != "" {
-		prefix := defaultPrefix
-		subQuery := SubQuery{
-			Field:    parentField,
-			Operator: parentOperator,
-		}
-		var sm []string
+	var clauses []clause
+	for t := p.peek(); t != nil; t = p.peek() {
+		prefix := p.defaultPrefix
+		subQuery := parent
+		clauseStart := t.Start
 
 		// return from recursive call if meeting a ')'
-		if s[0] == ')' {
+		if t.Kind == TokenCloseParen {
 			break
 		}
+		p.clauses++
+		if p.maxClauses > 0 && p.clauses > p.maxClauses {
+			err = newParseError(p.input, clauseStart, ErrorTooManyClauses, nil, "More than %d clauses", p.maxClauses)
+			return
+		}
 
 		// Parse prefix ('+', '-' or 'NOT')
-		if sm = R.Prefix.FindStringSubmatch(s); len(sm) > 0 {
-			prefix = sm[1]
-			s = s[len(sm[0]):]
-		} else if sm = R.PrefixWord.FindStringSubmatch(s); len(sm) > 0 {
+		switch t.Kind {
+		case TokenPrefix:
+			prefix = t.Value
+			p.pos++
+		case TokenNot:
 			prefix = PrefixExcluded
-			s = s[len(sm[0]):]
+			p.pos++
 		}
+		fieldStart := p.offset()
 
 		// Parse field name and operator
-		for _, re := range fieldOperators {
-			sm = re.FindStringSubmatch(s)
-			if len(sm) == 0 {
-				continue
+		explicitOp := false
+		if t = p.peek(); t != nil && (t.Kind == TokenField || t.Kind == TokenOperator) {
+			explicitOp = true
+			subQuery.Field = ""
+			if t.Kind == TokenField {
+				if subQuery.Field, err = p.field(t); err != nil {
+					return
+				}
+				p.pos++
 			}
-			subQuery.Field, subQuery.Operator = sm[1], Operator(sm[2])
-			if parentField != "" {
-				err = fmt.Errorf("Field '%s' inside '%s'", subQuery.Field, parentField)
+			t = p.peek()
+			subQuery.Operator, subQuery.Slop = Operator(t.Value), 0
+			if slop := strings.TrimPrefix(t.Value, "~"); slop != t.Value && slop != "" {
+				if subQuery.Slop, err = p.slop(t.Start, slop); err != nil {
+					return
+				}
+				subQuery.Operator = OperatorProximity
 			}
-			s = s[len(sm[0]):]
-			break
-		}
-
-		// Term matching
-		for _, re := range terms {
-			sm = re.FindStringSubmatch(s)
-			if len(sm) == 0 {
-				continue
+			p.pos++
+			if parent.Field != "" {
+				err = newParseError(p.input, fieldStart, ErrorFieldInsideField, []string{ExpectTerm, ExpectOpenParen}, "Field '%s' inside '%s'", subQuery.Field, parent.Field)
+				return
 			}
-			subQuery.Quote = Quote(sm[1])
-			subQuery.Value = sm[2]
-			s = s[len(sm[0]):]
-			goto BooleanOperators
 		}
 
-		// Parenthesis matching
-		if sm = R.OpenParen.FindStringSubmatch(s); len(sm) > 0 {
-			subQuery.Query, s, err = parse(s[len(sm[0]):], defaultPrefix, subQuery.Field, subQuery.Operator)
+		valueStart := p.offset()
+		// Set for the group withDefaultField makes of a term with several
+		// default fields
+		expanded := false
+		if t = p.peekKind(TokenTerm); t != nil {
+			// Term matching
+			termStart := t.Start
+			subQuery.Quote = t.Quote
+			subQuery.Value = t.Value
+			if t.Quote == QuoteNone && hasPattern(subQuery.Operator) {
+				subQuery.Pattern, subQuery.Value = classify(p.input[t.Start:t.End], t.Value)
+			}
+			p.pos++
+			// Fuzzy suffix: foo~2
+			if t = p.peekKind(TokenFuzzy); t != nil {
+				if err = p.fuzzy(&subQuery, t); err != nil {
+					return
+				}
+				p.pos++
+			}
+			if isRegex(subQuery.Operator) {
+				if err = p.regexp(&subQuery, termStart); err != nil {
+					return
+				}
+			}
+			// Phrase proximity suffix: "red hat"~5
+			if t = p.peekKind(TokenSlop); t != nil {
+				if subQuery.Operator != OperatorField && subQuery.Operator != OperatorProximity {
+					err = newParseError(p.input, t.Start, ErrorUnexpected, []string{ExpectTerm}, "Proximity %s cannot follow operator %s", p.input[t.Start:t.End], subQuery.Operator)
+					return
+				}
+				if subQuery.Slop, err = p.slop(t.Start, t.Value); err != nil {
+					return
+				}
+				subQuery.Operator = OperatorProximity
+				p.pos++
+			}
+			subQuery = p.withDefaultField(subQuery)
+			expanded = subQuery.Operator == OperatorSubquery
+		} else if t = p.peekKind(TokenOpenRange); t != nil {
+			// Range matching
+			if explicitOp && subQuery.Operator != OperatorField {
+				err = newParseError(p.input, t.Start, ErrorUnexpected, []string{ExpectTerm, ExpectOpenParen}, "Range cannot follow operator %s", subQuery.Operator)
+				return
+			}
+			if subQuery, err = p.parseRange(subQuery); err != nil {
+				return
+			}
+			subQuery = p.withDefaultField(subQuery)
+			expanded = subQuery.Operator == OperatorSubquery
+		} else if t = p.peekKind(TokenOpenParen); t != nil {
+			// Parenthesis matching
+			open := t.Start
+			if p.maxDepth > 0 && p.depth >= p.maxDepth {
+				err = newParseError(p.input, open, ErrorTooDeep, nil, "Groups nested deeper than %d", p.maxDepth)
+				return
+			}
+			p.pos++
+			p.depth++
+			subQuery.Query, err = p.parse(subQuery)
+			p.depth--
 			// Important not to pass OperatorSubquery into the sub-parse
-			subQuery.Operator = OperatorSubquery
+			subQuery.Operator, subQuery.Slop = OperatorSubquery, 0
 			if err != nil {
 				return
 			}
-			p := R.CloseParen.FindString(s)
-			if p == "" {
-				err = fmt.Errorf("No matching )")
+			if p.peekKind(TokenCloseParen) == nil {
+				err = newParseError(p.input, open, ErrorUnbalancedParen, []string{ExpectCloseParen}, "No matching )")
+				return
 			}
-			s = s[len(p):]
+			p.pos++
+		}
+
+		if t = p.peekKind(TokenBoost); t != nil {
+			if subQuery.Boost, err = p.boost(t); err != nil {
+				return
+			}
+			p.pos++
 		}
 
 		if subQuery.Operator == OperatorNone {
-			err = fmt.Errorf("Unexpected string in query: %s", s)
+			err = newParseError(p.input, fieldStart, ErrorUnexpected, []string{ExpectField, ExpectTerm, ExpectOpenParen}, "Unexpected string in query: %s", p.input[fieldStart:])
 			return
 		}
+		if p.schema != nil && subQuery.Operator != OperatorSubquery {
+			if code, e := p.schema.validate(&subQuery); e != nil {
+				err = newParseError(p.input, valueStart, code, nil, "%s", e)
+				return
+			}
+		} else if p.schema != nil && expanded {
+			for i := range subQuery.Query.Optional {
+				if code, e := p.schema.validate(&subQuery.Query.Optional[i]); e != nil {
+					err = newParseError(p.input, valueStart, code, nil, "%s", e)
+					return
+				}
+			}
+		}
 
 		// Boolean Operators
-	BooleanOperators:
-
 		postBool := ""
-		if and, or := R.BoolAnd.FindString(s), R.BoolOr.FindString(s); and != "" {
+		boolStart := p.offset()
+		if p.peekKind(TokenAnd) != nil {
 			postBool = "AND"
-			s = s[len(and):]
-		} else if or != "" {
+			p.pos++
+		} else if p.peekKind(TokenOr) != nil {
 			postBool = "OR"
-			s = s[len(or):]
+			p.pos++
+		}
+		if p.precedence {
+			clauses = append(clauses, clause{prefix, subQuery, clauseStart, postBool})
+			continue
 		}
 		if preBool != "" && postBool != "" && preBool != postBool {
-			err = fmt.Errorf("Cannot mix AND/OR; use parenthesis")
+			err = newParseError(p.input, boolStart, ErrorMixedBoolean, []string{preBool}, "Cannot mix AND/OR; use parenthesis")
 			return
 		}
 		Bool := preBool
@@ -219,31 +317,81 @@ func parse(s string, defaultPrefix string, parentField string, parentOperator Op
 		preBool = postBool
 
 		// Insert SubQuery into Query struct
-		switch {
-		case prefix == PrefixRequired && Bool == "OR":
-			prefix = PrefixOptional
-		case prefix == PrefixOptional && Bool == "AND":
-			prefix = PrefixRequired
-		case prefix == PrefixExcluded && Bool == "OR":
-			err = fmt.Errorf("Operands of OR cannot have - or NOT prefix")
+		if err = p.insert(q, prefix, Bool, subQuery, clauseStart); err != nil {
 			return
 		}
-		switch prefix {
-		case PrefixRequired:
-			q.Required = append(q.Required, subQuery)
-		case PrefixOptional:
-			q.Optional = append(q.Optional, subQuery)
-		case PrefixExcluded:
-			q.Excluded = append(q.Excluded, subQuery)
-		default:
-			err = fmt.Errorf("Invalid prefix: %s", prefix)
+	}
+
+	if p.precedence {
+		if err = p.combine(q, clauses, parent.Field); err != nil {
 			return
 		}
 	}
-
 	if len(q.Required) == 0 && len(q.Optional) == 0 {
-		err = fmt.Errorf("No positive value in query: %s", s)
+		err = newParseError(p.input, start, ErrorNoPositiveTerm, []string{ExpectTerm, ExpectOpenParen}, "No positive value in query: %s", p.input[start:p.offset()])
 	}
-	remaining = s
 	return
 }
+
+// insert adds sq to q according to its prefix and the boolean operator
+// joining it to its neighbours
+func (p *parseState) insert(q *Query, prefix, Bool string, sq SubQuery, clauseStart int) error {
+	switch {
+	case prefix == PrefixRequired && Bool == "OR":
+		prefix = PrefixOptional
+	case prefix == PrefixOptional && Bool == "AND":
+		prefix = PrefixRequired
+	case prefix == PrefixExcluded && Bool == "OR":
+		return newParseError(p.input, clauseStart, ErrorNegatedOrOperand, nil, "Operands of OR cannot have - or NOT prefix")
+	}
+	switch prefix {
+	case PrefixRequired:
+		q.Required = append(q.Required, sq)
+	case PrefixOptional:
+		q.Optional = append(q.Optional, sq)
+	case PrefixExcluded:
+		q.Excluded = append(q.Excluded, sq)
+	default:
+		return newParseError(p.input, clauseStart, ErrorInvalidPrefix, []string{PrefixRequired, PrefixExcluded}, "Invalid prefix: %s", prefix)
+	}
+	return nil
+}
+
+// defaultFuzzy is the edit distance of foo~, as in Lucene
+const defaultFuzzy = 2
+
+// fuzzy applies the fuzzy suffix t to sq. Operators without patterns
+// keep it as part of the value, so that txt~a~ is still the regex a~.
+func (p *parseState) fuzzy(sq *SubQuery, t *Token) (err error) {
+	if !hasPattern(sq.Operator) {
+		sq.Value += p.input[t.Start:t.End]
+		return
+	}
+	if sq.Pattern != PatternNone {
+		return newParseError(p.input, t.Start, ErrorUnexpected, nil, "Fuzzy %s cannot follow a %s term", p.input[t.Start:t.End], sq.Pattern)
+	}
+	if t.Value == "" {
+		sq.Fuzzy = defaultFuzzy
+		return
+	}
+	if sq.Fuzzy, err = strconv.Atoi(t.Value); err != nil {
+		return newParseError(p.input, t.Start, ErrorUnexpected, nil, "Invalid edit distance: %s", t.Value)
+	}
+	return
+}
+
+func (p *parseState) boost(t *Token) (float64, error) {
+	b, err := strconv.ParseFloat(t.Value, 64)
+	if err != nil || b <= 0 || math.IsInf(b, 0) {
+		return 0, newParseError(p.input, t.Start, ErrorUnexpected, nil, "Invalid boost: %s", t.Value)
+	}
+	return b, nil
+}
+
+func (p *parseState) slop(offset int, digits string) (int, error) {
+	n, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, newParseError(p.input, offset, ErrorUnexpected, nil, "Invalid proximity: %s", digits)
+	}
+	return n, nil
+}
@@ -1,7 +1,16 @@
 package searchquery
 
 import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var testSets = map[string]struct {
@@ -38,3 +47,1432 @@ func TestString(t *testing.T) {
 		}
 	}
 }
+
+var errorTests = []struct {
+	Input  string
+	Code   ErrorCode
+	Offset int
+	Line   int
+	Column int
+}{
+	{"(a b", ErrorUnbalancedParen, 0, 1, 1},
+	{"a b) c", ErrorUnbalancedParen, 3, 1, 4},
+	{"a AND b OR c", ErrorMixedBoolean, 8, 1, 9},
+	{"a OR -b", ErrorNegatedOrOperand, 5, 1, 6},
+	{"title:(body:a)", ErrorFieldInsideField, 7, 1, 8},
+	{"-a NOT b", ErrorNoPositiveTerm, 0, 1, 1},
+	{"a\nb AND (c\nd -é OR e)", ErrorNegatedOrOperand, 13, 3, 3},
+	{"[a TO b cdef", ErrorUnexpected, 0, 1, 1},
+	{"x date:[a TO b cdef", ErrorUnexpected, 7, 1, 8},
+}
+
+func TestParseError(t *testing.T) {
+	for i, test := range errorTests {
+		_, err := Parse(test.Input)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("[%d] Expected *ParseError for %q, got %v", i, test.Input, err)
+			continue
+		}
+		if pe.Code != test.Code || pe.Offset != test.Offset || pe.Line != test.Line || pe.Column != test.Column {
+			t.Errorf("[%d] Exp: %s@%d (%d:%d)", i, test.Code, test.Offset, test.Line, test.Column)
+			t.Errorf("[%d] Got: %s@%d (%d:%d) %s", i, pe.Code, pe.Offset, pe.Line, pe.Column, pe)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, test := range parseTests {
+			Parse(test.Input)
+		}
+	}
+}
+
+func BenchmarkParseGreedy(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, test := range parseGreedyTests {
+			ParseGreedy(test.Input)
+		}
+	}
+}
+
+func TestLex(t *testing.T) {
+	input := `-"f":'x y' ET (a OU b)NICHT c~5d`
+	exp := []Token{
+		{TokenPrefix, `-`, `-`, QuoteNone, 0, 1},
+		{TokenField, `"f"`, `f`, QuoteDouble, 1, 4},
+		{TokenOperator, `:`, `:`, QuoteNone, 4, 5},
+		{TokenTerm, `'x y'`, `x y`, QuoteSingle, 5, 10},
+		{TokenAnd, `ET`, `ET`, QuoteNone, 11, 13},
+		{TokenOpenParen, `(`, `(`, QuoteNone, 14, 15},
+		{TokenTerm, `a`, `a`, QuoteNone, 15, 16},
+		{TokenOr, `OU`, `OU`, QuoteNone, 17, 19},
+		{TokenTerm, `b`, `b`, QuoteNone, 20, 21},
+		{TokenCloseParen, `)`, `)`, QuoteNone, 21, 22},
+		{TokenNot, `NICHT`, `NICHT`, QuoteNone, 22, 27},
+		{TokenField, `c`, `c`, QuoteNone, 28, 29},
+		{TokenOperator, `~5`, `~5`, QuoteNone, 29, 31},
+		{TokenTerm, `d`, `d`, QuoteNone, 31, 32},
+	}
+	tokens, err := Lex(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != len(exp) {
+		t.Fatalf("Exp %d tokens, got %d: %v", len(exp), len(tokens), tokens)
+	}
+	for i := range exp {
+		if tokens[i] != exp[i] {
+			t.Errorf("[%d] Exp: %+v", i, exp[i])
+			t.Errorf("[%d] Got: %+v", i, tokens[i])
+		}
+	}
+
+	if _, err := Lex("(a (b)"); err == nil || err.(*ParseError).Offset != 0 {
+		t.Errorf("Expected unbalanced paren at 0, got %v", err)
+	}
+}
+
+func TestParserOptions(t *testing.T) {
+	tests := []struct {
+		Parser *Parser
+		Input  string
+		String string
+	}{
+		{NewParser(WithDefaultField("body")), "a title:b (c d)", "body:a OR title:b OR (body:c OR body:d)"},
+		{NewParser(WithDefaultField("title", "body")), "a -b title:c (d OR :e)", "(title:a OR body:a) OR title:c OR ((title:d OR body:d) OR (title:e OR body:e)) -(title:b OR body:b)"},
+		{NewParser(WithDefaultOperator(OperatorRegex)), "a title:b", "~a OR title:b"},
+		{NewParser(WithKeywords(KeywordsGerman)), "a UND b AND c", "AND OR c +a +b"},
+		{NewParser(WithKeywords(KeywordsEnglish)), "a ET b NOT c", `a OR \ET OR b -c`},
+		{NewParser(WithSingleQuotes(false)), `\'a OR b' OR c`, `\'a OR b' OR c`},
+		{NewParser(WithFieldRunes(func(r rune) bool { return r == '.' || isWordRune(r) })), "a.b:c", `"a.b":c`},
+	}
+	for i, test := range tests {
+		q, err := test.Parser.Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	for p, set := range testSets {
+		for i, test := range set.tests {
+			data, err := json.Marshal(test.Query)
+			if err != nil {
+				t.Errorf("[%s.%d] Error marshaling: %s", p, i, err)
+				continue
+			}
+			var q Query
+			if err = json.Unmarshal(data, &q); err != nil {
+				t.Errorf("[%s.%d] Error unmarshaling %s: %s", p, i, data, err)
+				continue
+			}
+			if !reflect.DeepEqual(q, test.Query) {
+				t.Errorf("[%s.%d] Exp: %#v", p, i, test.Query)
+				t.Errorf("[%s.%d] Got: %#v", p, i, q)
+			}
+		}
+	}
+
+	data, _ := json.Marshal(Query{Required: []SubQuery{{Field: "date", Operator: OperatorRelGTE, Quote: QuoteSingle, Value: "2001"}}})
+	if exp := `{"required":[{"field":"date","operator":"gte","quote":"single","value":"2001"}]}`; string(data) != exp {
+		t.Errorf("Exp: %s", exp)
+		t.Errorf("Got: %s", data)
+	}
+
+	invalid := []string{
+		`{}`,
+		`{"excluded":[{"operator":"field","value":"a"}]}`,
+		`{"optional":[{"operator":"like","value":"a"}]}`,
+		`{"optional":[{"operator":"field","quote":"back","value":"a"}]}`,
+		`{"optional":[{"operator":"field","value":"a","query":{"optional":[{"operator":"field"}]}}]}`,
+		`{"optional":[{"operator":"subquery"}]}`,
+		`{"optional":[{"operator":"subquery","value":"a","query":{"optional":[{"operator":"field"}]}}]}`,
+		`{"optional":[{"operator":"proximity","value":"a"}]}`,
+		`{"optional":[{"operator":"field","distance":2,"value":"a"}]}`,
+		`{"optional":[{"operator":"range","value":"a"}]}`,
+		`{"optional":[{"operator":"field","value":"a","range":{"lower":"a"}}]}`,
+		`{"optional":[{"operator":"range","range":{"min":"a"}}]}`,
+		`{"optional":[{"operator":"field","value":"a","pattern":"glob"}]}`,
+		`{"optional":[{"operator":"exact","value":"a","pattern":"prefix"}]}`,
+		`{"optional":[{"operator":"field","quote":"double","value":"a","pattern":"prefix"}]}`,
+		`{"optional":[{"operator":"field","value":"a","weight":2}]}`,
+		`{"optional":[{"operator":"field","value":"a","boost":-1}]}`,
+		`{"optional":[{"operator":"regex","value":"a","fuzzy":1}]}`,
+		`{"optional":[{"operator":"field","value":"a","pattern":"prefix","fuzzy":1}]}`,
+		`{"optional":[{"operator":"gte","value":"5"}]}`,
+		`{"optional":[{"operator":"not_field","value":"a"}]}`,
+		`{"optional":[{"operator":"proximity","distance":2,"value":"a"}]}`,
+		`{"optional":[{"field":"title","operator":"subquery","query":{"required":[{"field":"body","operator":"field","value":"a"}]}}]}`,
+		`{"optional":[{"field":"title","operator":"subquery","query":{"required":[{"operator":"subquery","query":{"optional":[{"field":"title","operator":"field","value":"a"}]}}]}}]}`,
+	}
+	for i, s := range invalid {
+		var q Query
+		if err := json.Unmarshal([]byte(s), &q); err == nil {
+			t.Errorf("[%d] Expected error unmarshaling %s", i, s)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	inputs := []string{"title:(a b)", "Id#(1 -2) c", "~(a b)", "title:(a (b c))", "a:"}
+	for _, test := range parseTests {
+		inputs = append(inputs, test.Input)
+	}
+	for i, input := range inputs {
+		exp, err := Parse(input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, input, err)
+			continue
+		}
+		text, _ := exp.MarshalText()
+		var got Query
+		if err = got.UnmarshalText(text); err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, text, err)
+			continue
+		}
+		if !reflect.DeepEqual(&got, exp) {
+			t.Errorf("[%d] Exp: %#v", i, exp)
+			t.Errorf("[%d] Got: %#v", i, got)
+		}
+	}
+}
+
+// queryGen generates random queries in the shape the parser produces
+type queryGen struct {
+	*rand.Rand
+	greedy bool
+}
+
+var (
+	genFields      = []string{"title", "date", "x_1", "author.name", "métadonnées", `my "field"`, "NOT"}
+	genOperators   = []string{":", "#", "~", "!~", "=~", "==", "=", "!=", "!:", "<", "<=", ">", ">=", "~3"}
+	genNoFieldOps  = []string{":", "#", "~", "!~", "=~"}
+	genBareChars   = []rune("abcxyzé_5 \\\"'():~#+-=!<>*,.N[]{}^")
+	genQuotedChars = []rune("ab \"'\\():~+-é")
+	genRangeChars  = []rune("a1 .:-*\"'\\[]{}T")
+)
+
+func (g queryGen) pick(s []string) string {
+	return s[g.Intn(len(s))]
+}
+
+func (g queryGen) text(chars []rune, min int) string {
+	r := make([]rune, min+g.Intn(5))
+	for i := range r {
+		r[i] = chars[g.Intn(len(chars))]
+	}
+	return string(r)
+}
+
+// query returns a Query whose terms inherit field and operator from term,
+// or have any when term is nil
+func (g queryGen) query(depth int, term *SubQuery) *Query {
+	q := new(Query)
+	n := func() int {
+		switch k := g.Intn(4); {
+		case g.greedy && k == 1:
+			return 2
+		default:
+			return k
+		}
+	}
+	q.Required = g.clauses(n(), depth, term)
+	q.Optional = g.clauses(n(), depth, term)
+	if len(q.Required) == 0 && len(q.Optional) == 0 {
+		q.Required = g.clauses(1, depth, term)
+	}
+	q.Excluded = g.clauses(g.Intn(2), depth, term)
+	return q
+}
+
+func (g queryGen) clauses(n, depth int, term *SubQuery) (sqs []SubQuery) {
+	for i := 0; i < n; i++ {
+		sqs = append(sqs, g.subQuery(depth, term))
+	}
+	return
+}
+
+func (g queryGen) subQuery(depth int, term *SubQuery) (sq SubQuery) {
+	defer func() {
+		if g.Intn(6) == 0 {
+			sq.Boost = []float64{0.5, 1, 2, 10.25}[g.Intn(4)]
+		}
+	}()
+	if term != nil {
+		sq = *term
+		sq.Boost = 0
+	} else if sq.Field = g.pick(append(genFields, "")); sq.Field == "" {
+		sq.Operator = Operator(g.pick(genNoFieldOps))
+	} else {
+		sq.Operator = Operator(g.pick(genOperators))
+	}
+	if sq.Operator == "~3" {
+		sq.Operator, sq.Slop = OperatorProximity, g.Intn(12)
+	}
+	if depth > 0 && g.Intn(4) == 0 {
+		if term == nil && g.Intn(2) == 0 {
+			sq.Query = g.query(depth-1, nil)
+			sq.Field = ""
+		} else {
+			inherit := sq
+			sq.Query = g.query(depth-1, &inherit)
+		}
+		sq.Operator, sq.Slop = OperatorSubquery, 0
+		return
+	}
+	// A range needs : unless the operator is inherited
+	if (term != nil || sq.Operator == OperatorField) && g.Intn(8) == 0 {
+		bound := func() string { return g.pick([]string{"", "*", "TO", g.text(genRangeChars, 1)}) }
+		sq.Operator, sq.Slop = OperatorRange, 0
+		sq.Range = &Range{Lower: bound(), Upper: bound(), IncludeLower: g.Intn(2) == 0, IncludeUpper: g.Intn(2) == 0}
+		return
+	}
+	switch g.Intn(3) {
+	case 0:
+		sq.Value = g.text(genBareChars, 1)
+		if hasPattern(sq.Operator) {
+			switch g.Intn(4) {
+			case 1:
+				sq.Pattern, sq.Value = PatternPrefix, g.text(genBareChars, 0)
+			case 2:
+				// Escape the literal characters around a wildcard
+				escape := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`).Replace
+				r := []rune(sq.Value)
+				i := g.Intn(len(r) + 1)
+				sq.Pattern, sq.Value = PatternWildcard, escape(string(r[:i]))+g.pick([]string{"?", "*?", "?*"})+escape(string(r[i:]))
+			case 3:
+				sq.Fuzzy = 1 + g.Intn(3)
+			}
+		}
+	case 1:
+		sq.Quote, sq.Value = QuoteSingle, g.text(genQuotedChars, 0)
+	case 2:
+		sq.Quote, sq.Value = QuoteDouble, g.text(genQuotedChars, 0)
+	}
+	// Phrase proximity suffix
+	if sq.Quote != QuoteNone && (sq.Operator == OperatorField || sq.Operator == OperatorProximity) && g.Intn(3) == 0 {
+		sq.Operator, sq.Slop = OperatorProximity, g.Intn(12)
+	}
+	return
+}
+
+func TestRoundTrip(t *testing.T) {
+	for p, greedy := range map[string]bool{"normal": false, "greedy": true} {
+		g := queryGen{rand.New(rand.NewSource(1)), greedy}
+		f := Parse
+		if greedy {
+			f = ParseGreedy
+		}
+		for i := 0; i < 2000; i++ {
+			exp := g.query(3, nil)
+			s := exp.String()
+			got, err := f(s)
+			if err != nil {
+				t.Errorf("[%s.%d] Error parsing %s: %s", p, i, s, err)
+				continue
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Errorf("[%s.%d] Input: %s", p, i, s)
+				t.Errorf("[%s.%d] Got:   %s", p, i, got)
+			}
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Value  string
+		String string
+	}{
+		{`"say \"hi\""`, `say "hi"`, `"say \"hi\""`},
+		{`'it\'s'`, `it's`, `'it\'s'`},
+		{`"a\b\\"`, `ab\`, `"ab\\"`},
+		{`f\(x\)`, `f(x)`, `f\(x\)`},
+		{`red\ hat`, `red hat`, `red\ hat`},
+		{`\-a`, `-a`, `\-a`},
+		{`\NOT`, `NOT`, `\NOT`},
+		{`a\:b`, `a:b`, `a\:b`},
+		{`\"a`, `"a`, `\"a`},
+		{`c:\\dir\\`, `\dir\`, `c:\\dir\\`},
+		{`\[a`, `[a`, `\[a`},
+		{`E-mail +urgent`, `E-mail`, `E-mail +urgent`},
+		{`O-b`, `O-b`, `O-b`},
+		{`O^Db`, `O^Db`, `O^Db`},
+		{`a OR \O`, `a`, `a OR \O`},
+		{`a OR O-b`, `a`, `a OR \O-b`},
+		{`a OR \&b`, `a`, `a OR \&b`},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		sq := append(q.Optional, q.Required...)[0]
+		if sq.Value != test.Value {
+			t.Errorf("[%d] Exp value: %s", i, test.Value)
+			t.Errorf("[%d] Got value: %s", i, sq.Value)
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	p := NewParser(WithPrecedence(true))
+	tests := []struct {
+		Input  string
+		String string
+	}{
+		{"a AND b OR c AND d", "(+a +b) OR (+c +d)"},
+		{"a OR b AND c", "a OR (+b +c)"},
+		{"a AND NOT b OR c", "(+a -b) OR c"},
+		{"x a AND b OR c", "x OR (+a +b) OR c"},
+		{"+x a AND b OR c -y", "(+a +b) OR c +x -y"},
+		{"title:(a AND b OR c)", "title:((+a +b) OR c)"},
+		{"a AND b c OR d", "c OR d +a +b"},
+	}
+	for i, test := range tests {
+		q, err := p.Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+
+	for _, input := range []string{"NOT a OR b AND c", "NOT a AND NOT b OR c"} {
+		if _, err := p.Parse(input); err == nil {
+			t.Errorf("Expected error parsing %s", input)
+		}
+	}
+
+	// Without mixing, precedence changes nothing
+	for i, test := range parseTests {
+		q, err := p.Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+}
+
+func TestProximity(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Field  string
+		Slop   int
+		String string
+	}{
+		{`"red hat"~5`, ``, 5, `"red hat"~5`},
+		{`body~5"red hat"`, `body`, 5, `body~5"red hat"`},
+		{`body:"red hat"~2`, `body`, 2, `body~2"red hat"`},
+		{`'x'~10`, ``, 10, `'x'~10`},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		sq := q.Optional[0]
+		if sq.Operator != OperatorProximity || sq.Field != test.Field || sq.Slop != test.Slop {
+			t.Errorf("[%d] Exp: %s %s %d", i, test.Field, OperatorProximity, test.Slop)
+			t.Errorf("[%d] Got: %s %s %d", i, sq.Field, sq.Operator, sq.Slop)
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+
+	for _, input := range []string{`f="a b"~5`, `f~99999999999999999999"a"`} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Expected error parsing %s", input)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Field  string
+		Range  Range
+		String string
+	}{
+		{`date:[2001 TO 2002]`, `date`, Range{Lower: "2001", Upper: "2002", IncludeLower: true, IncludeUpper: true}, `date:[2001 TO 2002]`},
+		{`date:{2001 TO 2002}`, `date`, Range{Lower: "2001", Upper: "2002", IncludeLower: false, IncludeUpper: false}, `date:{2001 TO 2002}`},
+		{`price:[ 10 TO * }`, `price`, Range{Lower: "10", Upper: "", IncludeLower: true, IncludeUpper: false}, `price:[10 TO *}`},
+		{`[* TO 'z z']`, ``, Range{Lower: "", Upper: "z z", IncludeLower: true, IncludeUpper: true}, `[* TO "z z"]`},
+		{`d:["*" TO \]]`, `d`, Range{Lower: "*", Upper: "]", IncludeLower: true, IncludeUpper: true}, `d:["*" TO "]"]`},
+		{`date:("01.01.2001" OR [a TO b])`, `date`, Range{Lower: "a", Upper: "b", IncludeLower: true, IncludeUpper: true}, `date:("01.01.2001" OR [a TO b])`},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		sq := q.Optional[0]
+		if sq.Query != nil {
+			sq = sq.Query.Optional[1]
+		}
+		if sq.Operator != OperatorRange || sq.Field != test.Field || *sq.Range != test.Range {
+			t.Errorf("[%d] Exp: %s %+v", i, test.Field, test.Range)
+			t.Errorf("[%d] Got: %s %s %+v", i, sq.Field, sq.Operator, sq.Range)
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+
+	for _, input := range []string{`date:[a TO b`, `date:[a b]`, `date:[a TO]`, `date>=[a TO b]`, `date:["" TO b]`} {
+		if _, err := Parse(input); err == nil {
+			t.Errorf("Expected error parsing %s", input)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		Input   string
+		Pattern Pattern
+		Value   string
+		String  string
+	}{
+		{`foo`, PatternNone, `foo`, `foo`},
+		{`foo*`, PatternPrefix, `foo`, `foo*`},
+		{`f?o`, PatternWildcard, `f?o`, `f?o`},
+		{`*oo`, PatternWildcard, `*oo`, `*oo`},
+		{`f\?o*`, PatternPrefix, `f?o`, `f\?o*`},
+		{`f\?o*?`, PatternWildcard, `f\?o*?`, `f\?o*?`},
+		{`foo\*`, PatternNone, `foo*`, `foo\*`},
+		{`\(a\\*`, PatternPrefix, `(a\`, `\(a\\*`},
+		{`title!:a*b`, PatternWildcard, `a*b`, `title!:a*b`},
+		{`title:"a*"`, PatternNone, `a*`, `title:"a*"`},
+		{`title=a*`, PatternNone, `a*`, `title=a*`},
+		{`txt~a.*`, PatternNone, `a.*`, `txt~a.*`},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		sq := q.Optional[0]
+		if sq.Pattern != test.Pattern || sq.Value != test.Value {
+			t.Errorf("[%d] Exp: %q %s", i, test.Pattern, test.Value)
+			t.Errorf("[%d] Got: %q %s", i, sq.Pattern, sq.Value)
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+}
+
+func TestBoost(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Boost  float64
+		String string
+	}{
+		{`foo^3`, 3, `foo^3`},
+		{`title:foo^0.5`, 0.5, `title:foo^0.5`},
+		{`"red hat"~5^2`, 2, `"red hat"~5^2`},
+		{`(a b)^1.5`, 1.5, `(a OR b)^1.5`},
+		{`title:(a b)^2`, 2, `title:(a OR b)^2`},
+		{`date:[a TO b]^4`, 4, `date:[a TO b]^4`},
+		{`foo*^2`, 2, `foo*^2`},
+		{`foo\^3`, 0, `foo\^3`},
+		{`^3`, 0, `\^3`},
+		{`a^b`, 0, `a^b`},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if sq := q.Optional[0]; sq.Boost != test.Boost {
+			t.Errorf("[%d] Exp boost: %v", i, test.Boost)
+			t.Errorf("[%d] Got boost: %v", i, sq.Boost)
+		} else if w := sq.Weight(); w != test.Boost && !(test.Boost == 0 && w == 1) {
+			t.Errorf("[%d] Exp weight %v, got %v", i, test.Boost, w)
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+
+	if _, err := Parse("a^0"); err == nil {
+		t.Errorf("Expected error parsing a^0")
+	}
+}
+
+func TestFuzzy(t *testing.T) {
+	tests := []struct {
+		Input    string
+		Operator Operator
+		Value    string
+		Fuzzy    int
+		String   string
+	}{
+		{`foo~`, OperatorField, `foo`, 2, `foo~2`},
+		{`foo~1`, OperatorField, `foo`, 1, `foo~1`},
+		{`title:foo~ bar`, OperatorField, `foo`, 2, `title:foo~2 OR bar`},
+		{`title!:foo~1^2`, OperatorFieldNeg, `foo`, 1, `title!:foo~1^2`},
+		{`(foo~)`, OperatorSubquery, ``, 0, `(foo~2)`},
+		{`foo\~`, OperatorField, `foo~`, 0, `foo\~`},
+		{`a-b~`, OperatorField, `a-b`, 2, `a-b~2`},
+		{`txt~'^foo.*'`, OperatorRegex, `^foo.*`, 0, `txt~'^foo.*'`},
+		{`txt~foo~`, OperatorRegex, `foo~`, 0, `txt~foo\~`},
+		{`body~5"red hat"`, OperatorProximity, `red hat`, 0, `body~5"red hat"`},
+		// A value for the operator must follow ~ directly; after
+		// whitespace word~ is a fuzzy term
+		{`body~5 "red hat"`, OperatorField, `body`, 5, `body~5 OR "red hat"`},
+		{`txt~ '^foo'`, OperatorField, `txt`, 2, `txt~2 OR '^foo'`},
+		{`txt ~ foo`, OperatorRegex, `foo`, 0, `txt~foo`},
+		{`title~2x`, OperatorProximity, `x`, 0, `title~2x`},
+		{`iphone~ case`, OperatorField, `iphone`, 2, `iphone~2 OR case`},
+		{`foo~2 bar`, OperatorField, `foo`, 2, `foo~2 OR bar`},
+		{`foo~ `, OperatorField, `foo`, 2, `foo~2`},
+		{`(foo~1 )`, OperatorSubquery, ``, 0, `(foo~1)`},
+		{`+bar foo~`, OperatorField, `foo`, 2, `foo~2 +bar`},
+		{`+bar foo~1^2`, OperatorField, `foo`, 1, `foo~1^2 +bar`},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		sq := q.Optional[0]
+		if sq.Operator != test.Operator || sq.Value != test.Value || sq.Fuzzy != test.Fuzzy {
+			t.Errorf("[%d] Exp: %s %s %d", i, test.Operator, test.Value, test.Fuzzy)
+			t.Errorf("[%d] Got: %s %s %d", i, sq.Operator, sq.Value, sq.Fuzzy)
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+		if got, err := Parse(test.String); err != nil || !reflect.DeepEqual(got, q) {
+			t.Errorf("[%d] %s does not read back: %v", i, test.String, err)
+		}
+	}
+
+	if _, err := Parse("foo*~1"); err == nil {
+		t.Errorf("Expected error parsing foo*~1")
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	tests := []struct {
+		Parser *Parser
+		Input  string
+		Field  string
+		String string
+	}{
+		{defaultParser, `"author.name":smith`, `author.name`, `"author.name":smith`},
+		{defaultParser, `'my \'field\'':x`, `my 'field'`, `"my 'field'":x`},
+		{defaultParser, `"a b"#(1 2)`, `a b`, `"a b"#(1 OR 2)`},
+		{defaultParser, `author.name:smith`, ``, `author.name\:smith`},
+		{NewParser(WithFieldRunes(FieldRunesPath)), `author.name:smith`, `author.name`, `"author.name":smith`},
+		{NewParser(WithFieldRunes(FieldRunesPath)), `meta-data:x`, `meta-data`, `"meta-data":x`},
+		{NewParser(WithFieldRunes(FieldRunesUnicode)), `métadonnées:x`, `métadonnées`, `"métadonnées":x`},
+		{NewParser(WithFieldRunes(FieldRunesUnicode)), `meta-data:x`, ``, `meta-data\:x`},
+	}
+	for i, test := range tests {
+		q, err := test.Parser.Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if sq := q.Optional[0]; sq.Field != test.Field {
+			t.Errorf("[%d] Exp field: %s", i, test.Field)
+			t.Errorf("[%d] Got field: %s", i, sq.Field)
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+}
+
+func TestFieldRegistry(t *testing.T) {
+	p := NewParser(
+		WithFields("sender_email", "created_at", "subject"),
+		WithFieldAliases(map[string]string{"from": "sender_email", "date": "created_at"}),
+	)
+	tests := []struct {
+		Input  string
+		String string
+	}{
+		{"from:bob date>=2001 subject:(a b)", "sender_email:bob OR created_at>=2001 OR subject:(a OR b)"},
+		{"sender_email:bob hello", "sender_email:bob OR hello"},
+	}
+	for i, test := range tests {
+		q, err := p.Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := q.String(); got != test.String {
+			t.Errorf("[%d] Exp: %s", i, test.String)
+			t.Errorf("[%d] Got: %s", i, got)
+		}
+	}
+
+	_, err := p.Parse("subject:a OR body:b")
+	if e, ok := err.(*ParseError); !ok || e.Code != ErrorUnknownField || e.Offset != 13 {
+		t.Errorf("Expected unknown field at 13, got %v", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	schema := Schema{
+		"title":  {Type: TypeString},
+		"count":  {Type: TypeInt},
+		"price":  {Type: TypeFloat},
+		"done":   {Type: TypeBool},
+		"date":   {Type: TypeDate},
+		"at":     {Type: TypeTime, Layouts: []string{"2006-01-02 15:04"}},
+		"status": {Type: TypeEnum, Values: []string{"open", "closed"}},
+		"ip":     {Type: TypeIP},
+	}
+	p := NewParser(WithSchema(schema))
+	tests := []struct {
+		Input string
+		Typed *Typed
+	}{
+		{"title:a*", &Typed{Value: "a"}},
+		{"count>=10", &Typed{Value: int64(10)}},
+		{"price<9.5", &Typed{Value: 9.5}},
+		{"done:true", &Typed{Value: true}},
+		{"date>='01.01.2001'", &Typed{Value: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)}},
+		{"at:'2001-02-03 04:05'", &Typed{Value: time.Date(2001, 2, 3, 4, 5, 0, 0, time.UTC)}},
+		{"status:open", &Typed{Value: "open"}},
+		{"ip:10.0.0.1", &Typed{Value: net.ParseIP("10.0.0.1")}},
+		{"count#'1, 2'", &Typed{Values: []interface{}{int64(1), int64(2)}}},
+		{"(x +count:3)", &Typed{Value: int64(3)}},
+		{"hello", nil},
+	}
+	for i, test := range tests {
+		q, err := p.Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		sq := append(q.Optional, q.Required...)[0]
+		if sq.Query != nil {
+			sq = sq.Query.Required[0]
+		}
+		if !reflect.DeepEqual(sq.Typed, test.Typed) {
+			t.Errorf("[%d] Exp: %#v", i, test.Typed)
+			t.Errorf("[%d] Got: %#v", i, sq.Typed)
+		}
+		// Converted values must not keep clauses from comparing with ==
+		if c := sq; c != sq {
+			t.Errorf("[%d] Clause differs from its copy", i)
+		}
+	}
+
+	q, err := p.Parse("count:[1 TO *]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := q.Optional[0].Range; r.TypedLower != int64(1) || r.TypedUpper != nil {
+		t.Errorf("Expected typed range [1 TO *], got %+v", r)
+	}
+
+	invalid := []struct {
+		Input  string
+		Code   ErrorCode
+		Offset int
+	}{
+		{"other:a", ErrorUnknownField, 0},
+		{"x +other:(a b)", ErrorUnknownField, 3},
+		{"count:abc", ErrorInvalidValue, 6},
+		{"count~'^1'", ErrorInvalidOperator, 6},
+		{"count:1*", ErrorInvalidOperator, 6},
+		{"title:a done>true", ErrorInvalidOperator, 13},
+		{"status:pending", ErrorInvalidValue, 7},
+		{"ip:[a TO b]", ErrorInvalidOperator, 3},
+		{"price:1.5~", ErrorInvalidOperator, 6},
+		{"date:'2001/01/01'", ErrorInvalidValue, 5},
+		{"count#'1, x'", ErrorInvalidValue, 6},
+		{"count:(1 OR x)", ErrorInvalidValue, 12},
+	}
+	for i, test := range invalid {
+		_, err := p.Parse(test.Input)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("[%d] Expected *ParseError parsing %s, got %v", i, test.Input, err)
+			continue
+		}
+		if pe.Code != test.Code || pe.Offset != test.Offset {
+			t.Errorf("[%d] %s: exp %s at %d, got %s at %d", i, test.Input, test.Code, test.Offset, pe.Code, pe.Offset)
+		}
+	}
+
+	// Each default field is checked against its own type
+	p = NewParser(WithSchema(schema), WithDefaultField("title", "count"))
+	if q, err := p.Parse("3"); err != nil {
+		t.Errorf("Error parsing 3 with default fields: %s", err)
+	} else if sq := q.Optional[0].Query.Optional[1]; sq.Typed == nil || sq.Typed.Value != int64(3) {
+		t.Errorf("Expected count:3 typed, got %+v", sq)
+	}
+	if _, err := p.Parse("1 abc"); err == nil || err.(*ParseError).Code != ErrorInvalidValue || err.(*ParseError).Offset != 2 {
+		t.Errorf("Expected invalid value for count at 2, got %v", err)
+	}
+	p = NewParser(WithSchema(schema), WithDefaultField("title", "other"))
+	if _, err := p.Parse("[a TO b]"); err == nil || err.(*ParseError).Code != ErrorUnknownField {
+		t.Errorf("Expected unknown default field, got %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		Parser *Parser
+		Valid  string
+		Input  string
+		Code   ErrorCode
+		Offset int
+	}{
+		{NewParser(WithMaxLength(5)), "a b c", "a b cd", ErrorTooLong, 5},
+		{NewParser(WithMaxLength(3)), "é", "ééé", ErrorTooLong, 2},
+		{NewParser(WithMaxDepth(2)), "((a) b)", "((a (b)))", ErrorTooDeep, 4},
+		{NewParser(WithMaxClauses(3)), "a (b)", "a (b c) d", ErrorTooManyClauses, 5},
+		{NewParser(WithMaxRegexLength(3)), "x~abc", "x~(a 'abcd')", ErrorRegexTooLong, 5},
+	}
+	for i, test := range tests {
+		if _, err := test.Parser.Parse(test.Valid); err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Valid, err)
+		}
+		_, err := test.Parser.Parse(test.Input)
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("[%d] Expected *ParseError for %q, got %v", i, test.Input, err)
+			continue
+		}
+		if e.Code != test.Code || e.Offset != test.Offset || !e.Code.IsLimit() {
+			t.Errorf("[%d] Exp: %s at %d", i, test.Code, test.Offset)
+			t.Errorf("[%d] Got: %s at %d", i, e.Code, e.Offset)
+		}
+	}
+}
+
+func TestRegex(t *testing.T) {
+	re2 := NewParser(WithRegexSyntax(RegexRE2))
+	restricted := NewParser(WithRegexSyntax(RegexRestricted))
+	complexity := NewParser(WithMaxRegexComplexity(50))
+
+	q, err := re2.Parse(`txt~'^foo.*' title:a body=~(x+ y)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re := q.Optional[0].Regexp; re == nil || !re.MatchString("foobar") {
+		t.Errorf("Expected compiled regex ^foo.*, got %v", re)
+	}
+	if q.Optional[1].Regexp != nil {
+		t.Errorf("Expected no regex for %s", q.Optional[1])
+	}
+	if g := q.Optional[2].Query; g.Optional[0].Regexp == nil || g.Optional[1].Regexp == nil {
+		t.Errorf("Expected compiled regexes in %s", q.Optional[2])
+	}
+	if q, _ = Parse(`txt~'^foo.*'`); q.Optional[0].Regexp != nil {
+		t.Errorf("Expected unchecked regex by default")
+	}
+
+	tests := []struct {
+		Parser *Parser
+		Valid  string
+		Input  string
+		Code   ErrorCode
+		Offset int
+	}{
+		{re2, `txt~'a(b)'`, `a txt~'a(b'`, ErrorInvalidRegex, 6},
+		{re2, `txt!~a{2}`, `txt!~(b a\\)`, ErrorInvalidRegex, 8},
+		{restricted, `txt~'a+b*(c|d)?'`, `txt~'a{2}'`, ErrorInvalidRegex, 4},
+		{restricted, `txt~'(ab)+'`, `txt~'(a+)+'`, ErrorInvalidRegex, 4},
+		{complexity, `txt~'a{10}'`, `x txt~'(a{10}){10}'`, ErrorRegexTooComplex, 6},
+		{complexity, `txt~'a{10}'`, `txt~'a{1000}'`, ErrorRegexTooComplex, 4},
+		{complexity, `txt~'a{10}'`, `txt~'(a{1000}){1000}'`, ErrorInvalidRegex, 4},
+	}
+	for i, test := range tests {
+		if _, err := test.Parser.Parse(test.Valid); err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Valid, err)
+		}
+		_, err := test.Parser.Parse(test.Input)
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("[%d] Expected *ParseError for %q, got %v", i, test.Input, err)
+			continue
+		}
+		if e.Code != test.Code || e.Offset != test.Offset {
+			t.Errorf("[%d] Exp: %s at %d", i, test.Code, test.Offset)
+			t.Errorf("[%d] Got: %s at %d: %s", i, e.Code, e.Offset, e)
+		}
+	}
+}
+
+var matchDoc = map[string]interface{}{
+	"title":  "The Quick brown Fox",
+	"body":   "jumps over the lazy dog",
+	"count":  42,
+	"price":  9.5,
+	"done":   true,
+	"date":   time.Date(2001, 6, 1, 0, 0, 0, 0, time.UTC),
+	"tags":   []string{"go", "search"},
+	"ip":     net.ParseIP("10.0.0.2"),
+	"author": map[string]interface{}{"name": "Smith"},
+	"stock":  "42",
+	"opened": "01.06.2001",
+	"host":   "10.0.0.10",
+}
+
+var matchTests = []struct {
+	Input string
+	Match bool
+}{
+	{"quick", true},
+	{"slow", false},
+	{"title:fox", true},
+	{"title:dog", false},
+	{`title:"quick brown"`, true},
+	{`title:"brown quick"`, false},
+	{`title:"quick fox"~1`, true},
+	{`title:"fox quick"~2`, false},
+	{`body:"lazy jumps"~4`, true},
+	{"title:qui*", true},
+	{"title:q?ick", true},
+	{"title:*ox", true},
+	{"title:quack~1", true},
+	{"title:quack~", true},
+	{"title:qu~1", false},
+	{"title!:fox", false},
+	{"title!:cat", true},
+	{"missing!:cat", true},
+	{"title~'^The'", true},
+	{"title~'^the'", false},
+	{"title!~'^The'", false},
+	{"title=~Fox$", true},
+	{"count>40", true},
+	{"count>=42 count<=42", true},
+	{"+count<42", false},
+	{"count==42.0", true},
+	{"count!=42", false},
+	{"price<10", true},
+	{"done:true", true},
+	{"done=false", false},
+	{"date>='01.01.2001'", true},
+	{"date<2001-01-01", false},
+	{"date:[2001-01-01 TO 2001-12-31]", true},
+	{"date:{2001-06-01 TO *]", false},
+	{"count:[40 TO 42}", false},
+	{"tags:search", true},
+	{"tags#'java, go'", true},
+	{"tags#java", false},
+	{"ip>=10.0.0.1", true},
+	{`"author.name":smith`, true},
+	{"stock>5", true},
+	{"stock>100", false},
+	{"stock==42.0", true},
+	{"stock:[5 TO 50]", true},
+	{"stock#'1, 42.0'", true},
+	{"opened>=2001-01-01", true},
+	{"opened<2001-06-01", false},
+	{"host>10.0.0.9", true},
+	{"+quick +lazy -cat", true},
+	{"+quick -lazy", false},
+	{"cat OR lazy", true},
+	{"+quick cat", true},
+	{"title:(cat OR fox) +count:42", true},
+	{"(+cat +dog) OR (+quick +fox)", true},
+}
+
+var matchModeTests = []struct {
+	Options []MatchOption
+	Input   string
+	Match   bool
+}{
+	{[]MatchOption{WithCaseFolding(false)}, "title:quick", false},
+	{[]MatchOption{WithCaseFolding(false)}, "title:Quick", true},
+	{[]MatchOption{WithTextMode(TextSubstring)}, "title:ick", true},
+	{[]MatchOption{WithTextMode(TextSubstring)}, "title:'k bro'", true},
+	{[]MatchOption{WithTextMode(TextTokens)}, "title:ick", false},
+	{[]MatchOption{WithTextMode(TextWhole)}, "title:fox", false},
+	{[]MatchOption{WithTextMode(TextWhole)}, "title:'the quick brown fox'", true},
+	{[]MatchOption{WithTextMode(TextWhole)}, "title:the*", true},
+}
+
+func TestMatch(t *testing.T) {
+	for i, test := range matchTests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := q.Match(matchDoc); got != test.Match {
+			t.Errorf("[%d] %s: exp %v, got %v", i, test.Input, test.Match, got)
+		}
+	}
+	for i, test := range matchModeTests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := NewMatcher(test.Options...).Match(*q, matchDoc); got != test.Match {
+			t.Errorf("[%d] %s: exp %v, got %v", i, test.Input, test.Match, got)
+		}
+	}
+
+	// Regexes are compiled when a query does not carry them
+	for op, exp := range map[Operator]bool{OperatorRegex: false, OperatorRegexNeg: true} {
+		q := Query{Required: []SubQuery{{Field: "title", Operator: op, Value: "("}}}
+		if got := q.Match(matchDoc); got != exp {
+			t.Errorf("%s invalid regex: exp %v, got %v", op, exp, got)
+		}
+		q.Required[0].Value = "^The"
+		if got := q.Match(matchDoc); got == exp {
+			t.Errorf("%s ^The: exp %v, got %v", op, !exp, got)
+		}
+	}
+}
+
+type matchAuthor struct {
+	Name  string `searchquery:"name"`
+	Email string `searchquery:"-"`
+}
+
+type matchAudit struct {
+	Created time.Time
+	Deleted *time.Time
+}
+
+type matchPost struct {
+	matchAudit
+	Title   string
+	Views   uint32 `searchquery:"views"`
+	Score   *float64
+	Author  *matchAuthor
+	Editors []matchAuthor
+	Tags    []string
+	secret  string
+}
+
+func TestMatchStruct(t *testing.T) {
+	score := 4.5
+	post := &matchPost{
+		matchAudit: matchAudit{Created: time.Date(2001, 6, 1, 0, 0, 0, 0, time.UTC)},
+		Title:      "Struct matching",
+		Views:      120,
+		Score:      &score,
+		Author:     &matchAuthor{Name: "Smith", Email: "smith@example.com"},
+		Editors:    []matchAuthor{{Name: "Jones"}, {Name: "Brown"}},
+		Tags:       []string{"go", "reflect"},
+		secret:     "hidden",
+	}
+	tests := []struct {
+		Input string
+		Match bool
+	}{
+		{"title:matching", true},
+		{"Title:struct", true},
+		{"views>100", true},
+		{"views:[1 TO 100]", false},
+		{"score>=4.5", true},
+		{"created<2002-01-01", true},
+		{"deleted!:*", true},
+		{`"author.name":smith`, true},
+		{`"author.email":smith`, false},
+		{"smith@example.com", false},
+		{"hidden", false},
+		{`"editors.name":brown`, true},
+		{`"editors.name"!:jones`, false},
+		{"tags:reflect -tags:java", true},
+		{"jones", true},
+		{"missing:x", false},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := q.Match(post); got != test.Match {
+			t.Errorf("[%d] %s: exp %v, got %v", i, test.Input, test.Match, got)
+		}
+		// Plans are cached, so a second pass must agree
+		if got := q.Match(*post); got != test.Match {
+			t.Errorf("[%d] %s by value: exp %v, got %v", i, test.Input, test.Match, got)
+		}
+	}
+
+	var nilPost *matchPost
+	if q, _ := Parse("title:x"); q.Match(nilPost) {
+		t.Errorf("Nil pointer matched")
+	}
+	if q, _ := Parse("-title:x"); q.Match(nilPost) {
+		t.Errorf("Nil pointer matched without a required clause")
+	}
+
+	// Documents that refer back to themselves are walked once
+	type node struct {
+		Name string
+		Next *node
+		List []interface{}
+	}
+	n := &node{Name: "a"}
+	n.Next = n
+	n.List = []interface{}{n, nil}
+	n.List[1] = n.List
+	m := map[string]interface{}{"name": "b"}
+	m["self"] = m
+	m["list"] = []interface{}{m}
+	for _, test := range []struct {
+		Input string
+		Doc   interface{}
+		Match bool
+	}{
+		{"x", n, false},
+		{"a", n, true},
+		{`"next.next.name":a`, n, true},
+		{`"list.name":a`, n, true},
+		{"list.x:a", n, false},
+		{"x", m, false},
+		{"b", m, true},
+		{`"self.self.name":b`, m, true},
+		{`"list.list.name":b`, m, true},
+	} {
+		q, _ := Parse(test.Input)
+		prog, _ := Compile(q)
+		if got := q.Match(test.Doc); got != test.Match || prog.Match(test.Doc) != test.Match {
+			t.Errorf("%s on a cycle: exp %v, got %v", test.Input, test.Match, got)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	for i, test := range matchTests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		p, err := Compile(q)
+		if err != nil {
+			t.Errorf("[%d] Error compiling %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := p.Match(matchDoc); got != test.Match {
+			t.Errorf("[%d] %s: exp %v, got %v", i, test.Input, test.Match, got)
+		}
+	}
+	for i, test := range matchModeTests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		p, err := Compile(q, test.Options...)
+		if err != nil {
+			t.Errorf("[%d] Error compiling %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := p.Match(matchDoc); got != test.Match {
+			t.Errorf("[%d] %s: exp %v, got %v", i, test.Input, test.Match, got)
+		}
+	}
+
+	if _, err := Compile(&Query{Required: []SubQuery{{Operator: OperatorRegex, Field: "a", Value: "("}}}); err == nil {
+		t.Errorf("Expected error compiling an invalid regex")
+	}
+
+	doc := map[string]interface{}{
+		"title": "The Quick brown Fox",
+		"count": 42.0,
+		"tags":  []string{"go", "search"},
+		"meta":  map[string]interface{}{"lang": "EN", "size": 3},
+	}
+	for _, input := range []string{
+		"title:qui* +count>40 tags#'java, go' -title:cat",
+		"title:'quick brown' OR title:q?ick",
+		"title~'^The' title:quack~1",
+		"count:[40 TO 50] +en",
+		"-tags:java +count==42 +title:{a TO z}",
+	} {
+		q, err := Parse(input)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", input, err)
+		}
+		p, err := Compile(q)
+		if err != nil {
+			t.Fatalf("Error compiling %s: %s", input, err)
+		}
+		if !p.Match(doc) {
+			t.Errorf("%s: did not match", input)
+		}
+		if n := testing.AllocsPerRun(100, func() { p.Match(doc) }); n != 0 {
+			t.Errorf("%s: %v allocations per match", input, n)
+		}
+	}
+}
+
+func BenchmarkMatch(b *testing.B) {
+	q, _ := Parse("title:qui* +count>40 tags#'java, go' -title:cat title~'^The'")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		q.Match(matchDoc)
+	}
+}
+
+func BenchmarkProgramMatch(b *testing.B) {
+	q, _ := Parse("title:qui* +count>40 tags#'java, go' -title:cat title~'^The'")
+	p, _ := Compile(q)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.Match(matchDoc)
+	}
+}
+
+func TestPercolator(t *testing.T) {
+	p := NewPercolator()
+	for id, input := range map[string]string{
+		"fox":      "title:fox",
+		"phrase":   `+title:"brown fox" +count>40`,
+		"either":   "cat OR lazy",
+		"tags":     "tags#'go, java'",
+		"negation": "title!:cat",
+		"nested":   "+(title:cat OR author:smith) +done:true",
+		"miss":     "title:cat",
+	} {
+		q, err := Parse(input)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", input, err)
+		}
+		if err = p.Add(id, q); err != nil {
+			t.Fatalf("Error adding %s: %s", input, err)
+		}
+	}
+	doc := map[string]interface{}{
+		"title":  "The Quick brown Fox",
+		"body":   "jumps over the lazy dog",
+		"count":  42,
+		"done":   true,
+		"tags":   []string{"go", "search"},
+		"author": "Smith",
+	}
+	if got, exp := p.Match(doc), []string{"either", "fox", "negation", "nested", "phrase", "tags"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Exp %v, got %v", exp, got)
+	}
+
+	if !p.Remove("fox") || p.Remove("fox") {
+		t.Errorf("Remove did not report the stored query")
+	}
+	q, _ := Parse("title:dog")
+	p.Add("phrase", q)
+	if got, exp := p.Match(doc), []string{"either", "negation", "nested", "tags"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Exp %v, got %v", exp, got)
+	}
+	if p.Len() != 6 {
+		t.Errorf("Exp 6 queries, got %d", p.Len())
+	}
+	if err := p.Add("bad", &Query{Required: []SubQuery{{Operator: OperatorRegex, Value: "("}}}); err == nil {
+		t.Errorf("Expected error adding an invalid regex")
+	}
+
+	// A field named "" is searched like any other by unfielded terms
+	q, _ = Parse("fox")
+	p = NewPercolator()
+	p.Add("fox", q)
+	prog, _ := Compile(q)
+	empty := map[string]interface{}{"": "x", "title": "fox"}
+	if !q.Match(empty) || !prog.Match(empty) || !reflect.DeepEqual(p.Match(empty), []string{"fox"}) {
+		t.Errorf("Matcher, Program and Percolator disagree on %v", empty)
+	}
+
+	// The index must not change which queries match
+	g := queryGen{rand.New(rand.NewSource(1)), false}
+	docs := []map[string]interface{}{matchDoc, doc, {"a": "foo bar", "b": []interface{}{"x y", 3.0}}, empty}
+	for _, opts := range [][]MatchOption{nil, {WithTextMode(TextSubstring)}, {WithTextMode(TextWhole), WithCaseFolding(false)}} {
+		p := NewPercolator(opts...)
+		progs := make(map[string]*Program)
+		for i := 0; i < 2000; i++ {
+			q := g.query(3, nil)
+			id := strconv.Itoa(i)
+			if err := p.Add(id, q); err != nil {
+				continue
+			}
+			progs[id], _ = Compile(q, opts...)
+		}
+		for i, doc := range docs {
+			var exp []string
+			for id, prog := range progs {
+				if prog.Match(doc) {
+					exp = append(exp, id)
+				}
+			}
+			sort.Strings(exp)
+			if got := p.Match(doc); !reflect.DeepEqual(got, exp) {
+				t.Errorf("[%d] Exp %v, got %v", i, exp, got)
+			}
+		}
+	}
+}
+
+// percolatorQueries returns n queries for the percolator benchmarks
+func percolatorQueries(n int) []*Query {
+	r := rand.New(rand.NewSource(1))
+	queries := make([]*Query, n)
+	for i := range queries {
+		var input string
+		switch i % 3 {
+		case 0:
+			input = fmt.Sprintf("+title:w%d +count>%d", r.Intn(n), r.Intn(100))
+		case 1:
+			input = fmt.Sprintf(`body:"w%d w%d" OR tags:t%d`, r.Intn(n), r.Intn(n), r.Intn(n/10+1))
+		default:
+			input = fmt.Sprintf("+tags#'t%d, t%d' -title:w%d", r.Intn(n/10+1), r.Intn(n/10+1), r.Intn(n))
+		}
+		queries[i], _ = Parse(input)
+	}
+	return queries
+}
+
+var percolatorDoc = map[string]interface{}{
+	"title": "w1 w20 w300",
+	"body":  "w1 w2 w3 w4 w5 w6 w7 w8",
+	"count": 50,
+	"tags":  []string{"t1", "t2"},
+}
+
+func BenchmarkPercolator(b *testing.B) {
+	p := NewPercolator()
+	for i, q := range percolatorQueries(50000) {
+		p.Add(strconv.Itoa(i), q)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p.Match(percolatorDoc)
+	}
+}
+
+func BenchmarkPercolatorNaive(b *testing.B) {
+	var progs []*Program
+	for _, q := range percolatorQueries(50000) {
+		prog, _ := Compile(q)
+		progs = append(progs, prog)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, prog := range progs {
+			prog.Match(percolatorDoc)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	x := NewIndex()
+	x.Add("1", map[string]string{"title": "The Quick brown Fox", "body": "jumps over the lazy dog", "count": "42", "tag": "go"})
+	x.Add("2", map[string]string{"title": "A slow brown dog", "body": "sleeps all day", "count": "7", "tag": "java"})
+	x.Add("3", map[string]string{"title": "Quick thinking", "count": "100", "tag": "rust"})
+	x.Add("4", map[string]string{"title": "removed", "count": "1"})
+	if !x.Remove("4") || x.Remove("4") {
+		t.Errorf("Remove did not report the indexed document")
+	}
+	x.Add("3", map[string]string{"title": "Quick thinking", "count": "100", "tag": "Go"})
+	if x.Len() != 3 {
+		t.Errorf("Exp 3 documents, got %d", x.Len())
+	}
+
+	tests := []struct {
+		Input string
+		IDs   []string
+	}{
+		{"quick", []string{"1", "3"}},
+		{"title:dog", []string{"2"}},
+		{"dog", []string{"1", "2"}},
+		{`title:"brown fox"`, []string{"1"}},
+		{`title:"fox brown"`, []string{}},
+		{`title:"quick fox"~1`, []string{"1"}},
+		{"title:qu*", []string{"1", "3"}},
+		{"title:thinkin~1", []string{"3"}},
+		{"count>10", []string{"1", "3"}},
+		{"count<=42", []string{"1", "2"}},
+		{"count:[7 TO 42}", []string{"2"}},
+		{"count!=7", []string{"1", "3"}},
+		{"tag#'go, rust'", []string{"1", "3"}},
+		{"title~'^[AQ]'", []string{"2", "3"}},
+		{"title!~'^[AQ]'", []string{"1"}},
+		{"body!:dog", []string{"2", "3"}},
+		{"+quick -thinking", []string{"1"}},
+		{"+(brown OR thinking) +count>20", []string{"1", "3"}},
+		{"(+slow +dog) OR (+lazy +fox)", []string{"1", "2"}},
+		{"missing:x", []string{}},
+	}
+	for i, test := range tests {
+		q, err := Parse(test.Input)
+		if err != nil {
+			t.Errorf("[%d] Error parsing %s: %s", i, test.Input, err)
+			continue
+		}
+		if got := x.Search(q); !reflect.DeepEqual(got, test.IDs) {
+			t.Errorf("[%d] %s: exp %v, got %v", i, test.Input, test.IDs, got)
+		}
+	}
+
+	// Without numbers an Index finds what a Matcher matches
+	docs := map[string]map[string]string{
+		"a": {"title": "a b", "x_1": "xyz é", "author.name": "ab_c"},
+		"b": {"title": "b A x", "date": "5a-1"},
+		"c": {"NOT": "c", "métadonnées": "é a", `my "field"`: "'a'"},
+	}
+	x = NewIndex()
+	for id, doc := range docs {
+		x.Add(id, doc)
+	}
+	g := queryGen{rand.New(rand.NewSource(1)), false}
+	for i := 0; i < 2000; i++ {
+		q := g.query(3, nil)
+		exp := []string{}
+		for id, doc := range docs {
+			m := make(map[string]interface{}, len(doc))
+			for field, v := range doc {
+				m[field] = v
+			}
+			if q.Match(m) {
+				exp = append(exp, id)
+			}
+		}
+		sort.Strings(exp)
+		if got := x.Search(q); !reflect.DeepEqual(got, exp) {
+			t.Errorf("[%d] %s: exp %v, got %v", i, q, exp, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package searchquery
+
+import (
+	"strings"
+)
+
+// Range holds the bounds of a range query such as date:[2001 TO 2002}.
+// An empty bound is unbounded, written * in a query.
+type Range struct {
+	Lower        string `json:"lower,omitempty"`
+	Upper        string `json:"upper,omitempty"`
+	IncludeLower bool   `json:"include_lower,omitempty"` // [ rather than {
+	IncludeUpper bool   `json:"include_upper,omitempty"` // ] rather than }
+
+	// Bounds converted by Schema.Validate
+	TypedLower interface{} `json:"-"`
+	TypedUpper interface{} `json:"-"`
+}
+
+// rangeTo separates the bounds of a range; like Lucene it is not translated
+const rangeTo = "TO"
+
+// parseRange parses the range at the current token into sq
+func (p *parseState) parseRange(sq SubQuery) (SubQuery, error) {
+	// The token is overwritten as the lexer reads on
+	start := p.peek().Start
+	r := &Range{IncludeLower: p.peek().Value == "["}
+	p.pos++
+	var err error
+	if r.Lower, err = p.rangeBound(); err != nil {
+		return sq, err
+	}
+	if p.peekKind(TokenTo) == nil {
+		return sq, newParseError(p.input, p.offset(), ErrorUnexpected, []string{ExpectTo}, "Expected %s in range", rangeTo)
+	}
+	p.pos++
+	if r.Upper, err = p.rangeBound(); err != nil {
+		return sq, err
+	}
+	t := p.peekKind(TokenCloseRange)
+	if t == nil {
+		return sq, newParseError(p.input, start, ErrorUnexpected, []string{ExpectCloseRange}, "No matching ] or }")
+	}
+	r.IncludeUpper = t.Value == "]"
+	p.pos++
+
+	sq.Operator, sq.Slop, sq.Range = OperatorRange, 0, r
+	sq.Quote, sq.Value = QuoteNone, ""
+	return sq, nil
+}
+
+// rangeBound returns the bound at the current token, empty for *
+func (p *parseState) rangeBound() (string, error) {
+	t := p.peekKind(TokenTerm)
+	if t == nil {
+		return "", newParseError(p.input, p.offset(), ErrorUnexpected, []string{ExpectTerm}, "Expected range bound")
+	}
+	p.pos++
+	if t.Quote == QuoteNone && p.input[t.Start:t.End] == "*" {
+		return "", nil
+	}
+	if t.Value == "" {
+		return "", newParseError(p.input, t.Start, ErrorUnexpected, []string{ExpectTerm}, "Empty range bound; use * for an open range")
+	}
+	return t.Value, nil
+}
+
+func (r Range) String() string {
+	open, close := "{", "}"
+	if r.IncludeLower {
+		open = "["
+	}
+	if r.IncludeUpper {
+		close = "]"
+	}
+	return open + formatBound(r.Lower) + " " + rangeTo + " " + formatBound(r.Upper) + close
+}
+
+// formatBound writes a range bound, quoting it when it would not be read
+// back as a single bare bound
+func formatBound(v string) string {
+	switch {
+	case v == "":
+		return "*"
+	case v == "*" || strings.ContainsAny(v, " \t\n\f\r]}\\\"'"):
+		return quoteValue(v, QuoteDouble)
+	}
+	return v
+}
@@ -0,0 +1,90 @@
+package searchquery
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+// RegexSyntax selects how the parser checks the values of regex operators
+type RegexSyntax int
+
+const (
+	RegexUnchecked  RegexSyntax = iota // values are left as strings
+	RegexRE2                           // values must compile with package regexp
+	RegexRestricted                    // as RegexRE2, without counted or nested repetition
+)
+
+// WithRegexSyntax sets how values of regex operators are checked,
+// RegexUnchecked by default. Checked values are compiled into
+// SubQuery.Regexp; invalid ones are an ErrorInvalidRegex.
+func WithRegexSyntax(s RegexSyntax) Option {
+	return func(p *Parser) {
+		p.regexSyntax = s
+	}
+}
+
+// WithMaxRegexComplexity limits regex values to n instructions once
+// compiled, so that a short pattern such as a{1000} cannot take up memory.
+// More complex ones are an ErrorRegexTooComplex.
+func WithMaxRegexComplexity(n int) Option {
+	return func(p *Parser) {
+		p.maxRegexComplexity = n
+	}
+}
+
+func isRegex(op Operator) bool {
+	return op == OperatorRegex || op == OperatorRegexMatch || op == OperatorRegexNeg
+}
+
+// regexp checks the regex value of sq, which starts at offset, and
+// compiles it
+func (p *parseState) regexp(sq *SubQuery, offset int) error {
+	if p.maxRegexLength > 0 && len(sq.Value) > p.maxRegexLength {
+		return newParseError(p.input, offset, ErrorRegexTooLong, nil, "Regex longer than %d bytes", p.maxRegexLength)
+	}
+	if p.regexSyntax == RegexUnchecked && p.maxRegexComplexity == 0 {
+		return nil
+	}
+
+	re, err := syntax.Parse(sq.Value, syntax.Perl)
+	if err != nil {
+		return newParseError(p.input, offset, ErrorInvalidRegex, nil, "Invalid regex: %s", err)
+	}
+	if p.regexSyntax == RegexRestricted {
+		if sub := nestedRepeat(re, false); sub != nil {
+			return newParseError(p.input, offset, ErrorInvalidRegex, nil, "Invalid regex: repetition not allowed: %s", sub)
+		}
+	}
+	if p.maxRegexComplexity > 0 {
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil || len(prog.Inst) > p.maxRegexComplexity {
+			return newParseError(p.input, offset, ErrorRegexTooComplex, nil, "Regex more complex than %d instructions", p.maxRegexComplexity)
+		}
+	}
+	if p.regexSyntax != RegexUnchecked {
+		if sq.Regexp, err = regexp.Compile(sq.Value); err != nil {
+			return newParseError(p.input, offset, ErrorInvalidRegex, nil, "Invalid regex: %s", err)
+		}
+	}
+	return nil
+}
+
+// nestedRepeat returns the first counted repetition in re, or repetition
+// inside another one when repeated is set
+func nestedRepeat(re *syntax.Regexp, repeated bool) *syntax.Regexp {
+	switch re.Op {
+	case syntax.OpRepeat:
+		return re
+	case syntax.OpStar, syntax.OpPlus, syntax.OpQuest:
+		if repeated {
+			return re
+		}
+		repeated = true
+	}
+	for _, sub := range re.Sub {
+		if r := nestedRepeat(sub, repeated); r != nil {
+			return r
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package searchquery
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldType is the type of the values of a field in a Schema
+type FieldType int
+
+const (
+	TypeString FieldType = iota
+	TypeInt
+	TypeFloat
+	TypeBool
+	TypeDate
+	TypeTime
+	TypeEnum
+	TypeIP
+)
+
+var fieldTypeNames = map[FieldType]string{
+	TypeString: "string",
+	TypeInt:    "int",
+	TypeFloat:  "float",
+	TypeBool:   "bool",
+	TypeDate:   "date",
+	TypeTime:   "time",
+	TypeEnum:   "enum",
+	TypeIP:     "IP",
+}
+
+func (t FieldType) String() string {
+	if s, ok := fieldTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("FieldType(%d)", int(t))
+}
+
+// Layouts tried in order for TypeDate and TypeTime fields without Layouts
+var (
+	DefaultDateLayouts = []string{"2006-01-02", "02.01.2006"}
+	DefaultTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+)
+
+// Field describes the values of a field
+type Field struct {
+	Type    FieldType
+	Layouts []string // time.Parse layouts for TypeDate and TypeTime
+	Values  []string // allowed values for TypeEnum
+}
+
+// Schema describes the fields a query may use. Validate converts the value
+// of each clause into SubQuery.Typed.Value:
+//
+//	TypeString, TypeEnum  string
+//	TypeInt               int64
+//	TypeFloat             float64
+//	TypeBool              bool
+//	TypeDate, TypeTime    time.Time
+//	TypeIP                net.IP
+//
+// Values of OperatorCSV are converted into Typed.Values instead, and range
+// bounds into Range.TypedLower and Range.TypedUpper. Terms without a field
+// are left as they are.
+type Schema map[string]Field
+
+// Typed holds the value of a clause converted to the type of its field
+type Typed struct {
+	Value  interface{}
+	Values []interface{} // each value of an OperatorCSV term
+}
+
+// WithSchema validates each clause against s as it is parsed, so that Parse
+// and ParseGreedy return a *ParseError for an unknown field
+// (ErrorUnknownField), an operator the type of a field does not support
+// (ErrorInvalidOperator) or a value it cannot convert (ErrorInvalidValue)
+func WithSchema(s Schema) Option {
+	return func(p *Parser) {
+		p.schema = s
+	}
+}
+
+// Validate checks that every field of q is in s and that its operators
+// and values suit its type, converting the values. It is for queries not
+// read by a Parser configured WithSchema, which validates them already.
+func (s Schema) Validate(q *Query) error {
+	for _, clauses := range [][]SubQuery{q.Required, q.Optional, q.Excluded} {
+		for i := range clauses {
+			var err error
+			if clauses[i].Operator == OperatorSubquery {
+				err = s.Validate(clauses[i].Query)
+			} else {
+				_, err = s.validate(&clauses[i])
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate checks and converts a clause other than a group, returning the
+// code of its error
+func (s Schema) validate(sq *SubQuery) (code ErrorCode, err error) {
+	if sq.Field == "" {
+		return
+	}
+	f, ok := s[sq.Field]
+	if !ok {
+		return ErrorUnknownField, fmt.Errorf("Unknown field: %s", sq.Field)
+	}
+	if err = f.allows(sq); err != nil {
+		return ErrorInvalidOperator, fmt.Errorf("Field %s: %s", sq.Field, err)
+	}
+
+	switch {
+	case sq.Operator == OperatorRange:
+		if sq.Range.Lower != "" {
+			sq.Range.TypedLower, err = f.convert(sq.Range.Lower)
+		}
+		if err == nil && sq.Range.Upper != "" {
+			sq.Range.TypedUpper, err = f.convert(sq.Range.Upper)
+		}
+	case sq.Operator == OperatorCSV:
+		values := strings.Split(sq.Value, ",")
+		typed := &Typed{Values: make([]interface{}, len(values))}
+		for i, v := range values {
+			if typed.Values[i], err = f.convert(strings.TrimSpace(v)); err != nil {
+				break
+			}
+		}
+		sq.Typed = typed
+	case sq.Pattern != PatternNone || sq.Fuzzy > 0 || isRegex(sq.Operator):
+		sq.Typed = &Typed{Value: sq.Value}
+	default:
+		sq.Typed = new(Typed)
+		sq.Typed.Value, err = f.convert(sq.Value)
+	}
+	if err != nil {
+		return ErrorInvalidValue, fmt.Errorf("Field %s: %s", sq.Field, err)
+	}
+	return
+}
+
+// allows reports an error if sq cannot apply to a field of type f.Type
+func (f Field) allows(sq *SubQuery) error {
+	text := f.Type == TypeString
+	ordered := text || f.Type == TypeInt || f.Type == TypeFloat || f.Type == TypeDate || f.Type == TypeTime
+	switch {
+	case isRegex(sq.Operator) || sq.Operator == OperatorProximity:
+		if !text && f.Type != TypeEnum {
+			return fmt.Errorf("Operator %s cannot apply to type %s", sq.Operator, f.Type)
+		}
+	case sq.Operator == OperatorRange || sq.Operator == OperatorRelGT || sq.Operator == OperatorRelGTE || sq.Operator == OperatorRelLT || sq.Operator == OperatorRelLTE:
+		if !ordered {
+			return fmt.Errorf("Operator %s cannot apply to type %s", sq.Operator, f.Type)
+		}
+	}
+	if sq.Pattern != PatternNone && !text {
+		return fmt.Errorf("A %s pattern cannot apply to type %s", sq.Pattern, f.Type)
+	}
+	if sq.Fuzzy > 0 && !text {
+		return fmt.Errorf("A fuzzy term cannot apply to type %s", f.Type)
+	}
+	return nil
+}
+
+// convert returns v as a value of type f.Type
+func (f Field) convert(v string) (interface{}, error) {
+	switch f.Type {
+	case TypeString:
+		return v, nil
+	case TypeInt:
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return n, nil
+		}
+	case TypeFloat:
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n, nil
+		}
+	case TypeBool:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, nil
+		}
+	case TypeDate, TypeTime:
+		layouts := f.Layouts
+		if layouts == nil && f.Type == TypeDate {
+			layouts = DefaultDateLayouts
+		} else if layouts == nil {
+			layouts = DefaultTimeLayouts
+		}
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+	case TypeEnum:
+		for _, value := range f.Values {
+			if v == value {
+				return v, nil
+			}
+		}
+	case TypeIP:
+		if ip := net.ParseIP(v); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid %s: %q", f.Type, v)
+}
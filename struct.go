@@ -0,0 +1,124 @@
+package searchquery
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// structTag names the struct tag giving the field name of a struct field
+const structTag = "searchquery"
+
+// structField is a field of a struct as seen by a Matcher
+type structField struct {
+	name  string
+	index []int // through embedded structs, as in reflect.StructField
+}
+
+// value returns the field of v, or an invalid Value behind a nil pointer
+func (f *structField) value(v reflect.Value) reflect.Value {
+	for i, x := range f.index {
+		if i > 0 {
+			if v = indirect(v); !v.IsValid() {
+				return v
+			}
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+// structPlan holds the fields of a struct type
+type structPlan struct {
+	fields []structField
+	byName map[string]*structField
+	folded map[string]*structField // by lower-cased name
+}
+
+// structPlans caches plans by type
+var structPlans sync.Map // reflect.Type to *structPlan
+
+// planOf returns the plan of the struct type t
+func planOf(t reflect.Type) *structPlan {
+	if p, ok := structPlans.Load(t); ok {
+		return p.(*structPlan)
+	}
+	fields := structFields(t, map[reflect.Type]bool{})
+	p := &structPlan{
+		fields: fields,
+		byName: make(map[string]*structField, len(fields)),
+		folded: make(map[string]*structField, len(fields)),
+	}
+	for i := range fields {
+		f := &p.fields[i]
+		if _, ok := p.byName[f.name]; !ok {
+			p.byName[f.name] = f
+		}
+		if _, ok := p.folded[strings.ToLower(f.name)]; !ok {
+			p.folded[strings.ToLower(f.name)] = f
+		}
+	}
+	actual, _ := structPlans.LoadOrStore(t, p)
+	return actual.(*structPlan)
+}
+
+// field returns the field called name, compared case-insensitively when no
+// name matches exactly, or nil
+func (p *structPlan) field(name string) *structField {
+	if f, ok := p.byName[name]; ok {
+		return f
+	}
+	return p.folded[strings.ToLower(name)]
+}
+
+// structFields lists the exported fields of t followed by those promoted
+// from embedded structs, leaving out promoted fields hidden by another of
+// the same name
+func structFields(t reflect.Type, visiting map[reflect.Type]bool) []structField {
+	visiting[t] = true
+	defer delete(visiting, t)
+
+	var fields, promoted []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get(structTag)
+		if tag == "-" {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && tag == "" && ft.Kind() == reflect.Struct && ft != timeType {
+			// Fields behind an unexported embedded pointer cannot be read
+			if visiting[ft] || f.PkgPath != "" && f.Type.Kind() == reflect.Ptr {
+				continue
+			}
+			for _, e := range structFields(ft, visiting) {
+				e.index = append([]int{i}, e.index...)
+				promoted = append(promoted, e)
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := tag
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, structField{name: name, index: []int{i}})
+	}
+
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		seen[f.name] = true
+	}
+	for _, f := range promoted {
+		if !seen[f.name] {
+			seen[f.name] = true
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
@@ -64,7 +64,7 @@ sub writeTests {
 		my $qp = new Search::QueryParser;
 		my $query;
 		$query = $qp->parse($s, $greedy) or $query = "Error in query : " . $qp->err;
-		printf($fmt, sdump($s), sdump($qp->unparse($query)), go_Query($query, "\t\t"));
+		printf($fmt, sdump($s), sdump(go_String($query)), go_Query($query, "\t\t"));
 	}
 	print("}\n")
 }
@@ -74,6 +74,51 @@ sub sdump {
 	return substr(Dumper(shift), 5, -2)
 }
 
+# Canonical form of Query.String(): optional clauses joined by OR, then
+# required and excluded clauses with their prefix
+sub go_String {
+	my ($q, $field, $op) = @_;
+	$field = '' unless defined $field;
+	$op = ':' unless defined $op;
+
+	my @buf;
+	my @optional = map { go_SubString($_, $field, $op) } @{$q->{''} || []};
+	push @buf, join(' OR ', @optional) if @optional;
+	push @buf, '+' . go_SubString($_, $field, $op) foreach @{$q->{'+'} || []};
+	push @buf, '-' . go_SubString($_, $field, $op) foreach @{$q->{'-'} || []};
+	return join ' ', @buf;
+}
+
+sub go_SubString {
+	my ($subQ, $field, $op) = @_;
+	my $f = $subQ->{field} || '';
+
+	if ($subQ->{op} eq '()') {
+		return '(' . go_String($subQ->{value}, $field, $op) . ')' if $f eq $field;
+		my $leafOp = leaf_op($subQ->{value});
+		return "$f$leafOp(" . go_String($subQ->{value}, $f, $leafOp) . ')';
+	}
+
+	my $quote = $subQ->{quote} || '';
+	my $value = $subQ->{value};
+	if ($quote) {
+		$value =~ s/([\\$quote])/\\$1/g;
+		$value = "$quote$value$quote";
+	}
+	return $value if $f eq $field && $subQ->{op} eq $op && $value ne '';
+	return "$f$subQ->{op}$value";
+}
+
+sub leaf_op {
+	my $q = shift;
+	foreach my $subQ (map { @{$q->{$_} || []} } ('+', '', '-')) {
+		return $subQ->{op} if $subQ->{op} ne '()';
+		my $op = leaf_op($subQ->{value});
+		return $op if $op;
+	}
+	return '';
+}
+
 sub go_Query {
 	my $q = shift;
 	my $indent = shift;
@@ -9,7 +9,7 @@ type testType struct {
 var parseTests = []testType{
 	{
 		Input:  "a b",
-		String: ":a :b",
+		String: "a OR b",
 		Query: Query{
 			Optional: []SubQuery{
 				SubQuery{
@@ -27,7 +27,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "a OR b",
-		String: ":a :b",
+		String: "a OR b",
 		Query: Query{
 			Optional: []SubQuery{
 				SubQuery{
@@ -45,7 +45,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "a AND b",
-		String: "+:a +:b",
+		String: "+a +b",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -63,7 +63,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "txt~'^foo.*' date>='01.01.2001' date<='02.02.2002'",
-		String: "txt~'^foo.*' date>='01.01.2001' date<='02.02.2002'",
+		String: "txt~'^foo.*' OR date>='01.01.2001' OR date<='02.02.2002'",
 		Query: Query{
 			Optional: []SubQuery{
 				SubQuery{
@@ -89,7 +89,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "a AND (b OR c) AND NOT d",
-		String: "+:a +(:b :c) -:d",
+		String: "+a +(b OR c) -d",
 		Query: Query{
 			Excluded: []SubQuery{
 				SubQuery{
@@ -127,7 +127,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "+a +(b c) -d",
-		String: "+:a +(:b :c) -:d",
+		String: "+a +(b OR c) -d",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -165,7 +165,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "Id#123,444,555,666 AND (b OR c)",
-		String: "+Id#123,444,555,666 +(:b :c)",
+		String: "+Id#123,444,555,666 +(b OR c)",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -197,7 +197,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "+mandatoryWord -excludedWord +field:word \"exact phrase\"",
-		String: "+:mandatoryWord +field:word :\"exact phrase\" -:excludedWord",
+		String: "\"exact phrase\" +mandatoryWord +field:word -excludedWord",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -230,7 +230,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "\"Red Hat\" AND Google",
-		String: "+:\"Red Hat\" +:Google",
+		String: "+\"Red Hat\" +Google",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -248,7 +248,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "Google AND NOT \"Red Hat\"",
-		String: "+:Google -:\"Red Hat\"",
+		String: "+Google -\"Red Hat\"",
 		Query: Query{
 			Excluded: []SubQuery{
 				SubQuery{
@@ -268,7 +268,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "\"Red Hat\" OR \"Fusion IO\"",
-		String: ":\"Red Hat\" :\"Fusion IO\"",
+		String: "\"Red Hat\" OR \"Fusion IO\"",
 		Query: Query{
 			Optional: []SubQuery{
 				SubQuery{
@@ -286,7 +286,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "(\"Cloud Computing\" AND \"Red Hat\") (\"Cloud Computing\" AND \"Fusion IO\")",
-		String: "(+:\"Cloud Computing\" +:\"Red Hat\") (+:\"Cloud Computing\" +:\"Fusion IO\")",
+		String: "(+\"Cloud Computing\" +\"Red Hat\") OR (+\"Cloud Computing\" +\"Fusion IO\")",
 		Query: Query{
 			Optional: []SubQuery{
 				SubQuery{
@@ -330,7 +330,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "\"Cloud Computing\" AND (\"Red Hat\" OR \"Fusion IO\")",
-		String: "+:\"Cloud Computing\" +(:\"Red Hat\" :\"Fusion IO\")",
+		String: "+\"Cloud Computing\" +(\"Red Hat\" OR \"Fusion IO\")",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -361,7 +361,7 @@ var parseTests = []testType{
 	},
 	{
 		Input:  "\"Colon:In the Tech\" AND \"Red Hat\"",
-		String: "+:\"Colon:In the Tech\" +:\"Red Hat\"",
+		String: "+\"Colon:In the Tech\" +\"Red Hat\"",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -381,7 +381,7 @@ var parseTests = []testType{
 var parseGreedyTests = []testType{
 	{
 		Input:  "a b",
-		String: "+:a +:b",
+		String: "+a +b",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -399,7 +399,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "a OR b",
-		String: ":a :b",
+		String: "a OR b",
 		Query: Query{
 			Optional: []SubQuery{
 				SubQuery{
@@ -417,7 +417,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "a AND b",
-		String: "+:a +:b",
+		String: "+a +b",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -461,7 +461,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "a AND (b OR c) AND NOT d",
-		String: "+:a +(:b :c) -:d",
+		String: "+a +(b OR c) -d",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -499,7 +499,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "+a +(b c) -d",
-		String: "+:a +(+:b +:c) -:d",
+		String: "+a +(+b +c) -d",
 		Query: Query{
 			Excluded: []SubQuery{
 				SubQuery{
@@ -537,7 +537,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "Id#123,444,555,666 AND (b OR c)",
-		String: "+Id#123,444,555,666 +(:b :c)",
+		String: "+Id#123,444,555,666 +(b OR c)",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -569,7 +569,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "+mandatoryWord -excludedWord +field:word \"exact phrase\"",
-		String: "+:mandatoryWord +field:word +:\"exact phrase\" -:excludedWord",
+		String: "+mandatoryWord +field:word +\"exact phrase\" -excludedWord",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -600,7 +600,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "\"Red Hat\" AND Google",
-		String: "+:\"Red Hat\" +:Google",
+		String: "+\"Red Hat\" +Google",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -618,7 +618,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "Google AND NOT \"Red Hat\"",
-		String: "+:Google -:\"Red Hat\"",
+		String: "+Google -\"Red Hat\"",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -638,7 +638,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "\"Red Hat\" OR \"Fusion IO\"",
-		String: ":\"Red Hat\" :\"Fusion IO\"",
+		String: "\"Red Hat\" OR \"Fusion IO\"",
 		Query: Query{
 			Optional: []SubQuery{
 				SubQuery{
@@ -656,7 +656,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "(\"Cloud Computing\" AND \"Red Hat\") (\"Cloud Computing\" AND \"Fusion IO\")",
-		String: "+(+:\"Cloud Computing\" +:\"Red Hat\") +(+:\"Cloud Computing\" +:\"Fusion IO\")",
+		String: "+(+\"Cloud Computing\" +\"Red Hat\") +(+\"Cloud Computing\" +\"Fusion IO\")",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -700,7 +700,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "\"Cloud Computing\" AND (\"Red Hat\" OR \"Fusion IO\")",
-		String: "+:\"Cloud Computing\" +(:\"Red Hat\" :\"Fusion IO\")",
+		String: "+\"Cloud Computing\" +(\"Red Hat\" OR \"Fusion IO\")",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
@@ -731,7 +731,7 @@ var parseGreedyTests = []testType{
 	},
 	{
 		Input:  "\"Colon:In the Tech\" AND \"Red Hat\"",
-		String: "+:\"Colon:In the Tech\" +:\"Red Hat\"",
+		String: "+\"Colon:In the Tech\" +\"Red Hat\"",
 		Query: Query{
 			Required: []SubQuery{
 				SubQuery{
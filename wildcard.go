@@ -0,0 +1,82 @@
+package searchquery
+
+import (
+	"strings"
+)
+
+// Pattern classifies the value of a bare term matched with : or !:. A *
+// stands for any run of characters and a ? for a single one; a backslash
+// makes either literal.
+type Pattern string
+
+const (
+	PatternNone     Pattern = ``         // Value is matched exactly
+	PatternPrefix           = `prefix`   // foo*; Value holds foo
+	PatternWildcard         = `wildcard` // f?o*; Value holds the pattern
+)
+
+// In the Value of a PatternWildcard term, * and ? are wildcards and a
+// backslash escapes *, ? and itself, as in path.Match.
+
+// hasPattern reports whether terms with operator op are classified
+func hasPattern(op Operator) bool {
+	return op == OperatorField || op == OperatorFieldNeg
+}
+
+// classify returns the pattern of the bare term written as raw and its
+// Value. value is raw with escapes removed, as lexed.
+func classify(raw, value string) (Pattern, string) {
+	wildcards, last := 0, -1
+	for i := 0; i < len(raw); i++ {
+		switch raw[i] {
+		case '\\':
+			i++
+		case '*', '?':
+			wildcards++
+			last = i
+		}
+	}
+	switch {
+	case wildcards == 0:
+		return PatternNone, value
+	case wildcards == 1 && last == len(raw)-1 && raw[last] == '*':
+		return PatternPrefix, unescape(raw[:last])
+	}
+
+	// Keep only the escapes of wildcards and backslashes
+	var b strings.Builder
+	b.Grow(len(raw))
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c == '\\' {
+			if i+1 < len(raw) {
+				i++
+				c = raw[i]
+			}
+			if c == '*' || c == '?' || c == '\\' {
+				b.WriteByte('\\')
+			}
+		}
+		b.WriteByte(c)
+	}
+	return PatternWildcard, b.String()
+}
+
+// splitPattern returns the characters matched by pattern, marking which of
+// them are wildcards
+func splitPattern(pattern string) (literal string, wild []bool) {
+	var b strings.Builder
+	b.Grow(len(pattern))
+	wild = make([]bool, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		isWild := c == '*' || c == '?'
+		if c == '\\' && i+1 < len(pattern) {
+			i++
+			c = pattern[i]
+		}
+		b.WriteByte(c)
+		wild = append(wild, isWild)
+	}
+	return b.String(), wild
+}